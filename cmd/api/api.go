@@ -4,8 +4,10 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"myapp/internal/cards"
 	"myapp/internal/driver"
 	"myapp/internal/models"
+	"myapp/internal/tax"
 	"net/http"
 	"os"
 	"time"
@@ -20,8 +22,10 @@ type config struct {
 		dsn string
 	}
 	stripe struct {
-		secret string
-		key    string
+		secret        string
+		key           string
+		url           string
+		webhookSecret string
 	}
 	smtp struct {
 		host     string
@@ -31,6 +35,12 @@ type config struct {
 	}
 	secretKey string
 	frontEnd  string
+	static    string
+	// dunning is the number of days to wait before each retry of a failed
+	// renewal; the subscription is cancelled when the last retry fails
+	dunning []int
+	// tax charges GST on one time purchases
+	tax tax.Calculator
 }
 
 type application struct {
@@ -39,6 +49,7 @@ type application struct {
 	errorLog *log.Logger
 	version  string
 	DB       models.DBModel
+	Gateway  cards.PaymentGateway
 }
 
 func (app *application) serve() error {
@@ -66,11 +77,37 @@ func main() {
 	flag.StringVar(&cfg.smtp.password, "smtppass", "32886bcc818409", "smtp password")
 	flag.StringVar(&cfg.secretKey, "secret", "glhmfmfgjrtm23ouo6gu55kyedmglmng", "secret key")
 	flag.StringVar(&cfg.frontEnd, "frontend", "http://localhost:4000", "url to front end")
+	flag.StringVar(&cfg.stripe.url, "stripeurl", "", "override url for the stripe api")
+	flag.StringVar(&cfg.static, "static", "./static", "directory the web front end serves /static from")
+	dunning := flag.String("dunning", "3,5,7", "days between retries of a failed renewal, comma separated; turn off stripe's own retries when using this")
 
+	flag.StringVar(&cfg.tax.SellerState, "gst-state", "", "GST state code the seller is registered in, e.g. 27; empty charges no GST. Only one time purchases in INR are taxed, never subscriptions")
+	gstRate := flag.String("gst-rate", "18", "GST rate in percent")
 	flag.Parse()
 
+	schedule, err := parseDunningSchedule(*dunning)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.dunning = schedule
+
+	cfg.tax.Rate, err = tax.ParseRate(*gstRate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.tax.SellerState != "" {
+		if _, ok := tax.LookupState(cfg.tax.SellerState); !ok {
+			log.Fatalf("unknown GST state code %q", cfg.tax.SellerState)
+		}
+	}
+
 	cfg.stripe.key = os.Getenv("STRIPE_KEY")
 	cfg.stripe.secret = os.Getenv("STRIPE_SECRET")
+	cfg.stripe.webhookSecret = os.Getenv("STRIPE_WEBHOOK_SECRET")
+	if cfg.stripe.webhookSecret == "" {
+		// webhook events could be forged without a secret to check them against
+		log.Fatal("STRIPE_WEBHOOK_SECRET must be set")
+	}
 
 	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
 	errorLog := log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
@@ -88,8 +125,16 @@ func main() {
 		errorLog: errorLog,
 		version:  version,
 		DB:       models.DBModel{DB: conn},
+		Gateway: &cards.Card{
+			Secret:  cfg.stripe.secret,
+			Key:     cfg.stripe.key,
+			BaseURL: cfg.stripe.url,
+		},
 	}
 
+	go app.retryPastDueInvoices()
+	go app.cancelExpiredReservations()
+
 	err = app.serve()
 	if err != nil {
 		log.Fatal(err)
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"myapp/internal/models"
+	"myapp/internal/tax"
+	"myapp/internal/validator"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// couponCode is what a coupon code may look like once upper cased
+var couponCode = regexp.MustCompile(`^[A-Z0-9_-]{3,64}$`)
+
+// applyCoupon checks a coupon code against the priced items of a checkout and
+// returns the coupon and how much it takes off. The error is shown to the customer.
+func (app *application) applyCoupon(code, currency string, items []models.OrderItem) (models.Coupon, int, error) {
+	coupon, err := app.DB.GetCouponByCode(code)
+	if errors.Is(err, sql.ErrNoRows) {
+		return coupon, 0, errors.New("this coupon code is not valid")
+	} else if err != nil {
+		app.errorLog.Println(err)
+		return coupon, 0, errors.New("unable to check this coupon, please try again")
+	}
+
+	err = coupon.Usable(time.Now())
+	if err != nil {
+		return coupon, 0, err
+	}
+
+	discount, err := coupon.Discount(items, currency)
+	if err != nil {
+		if !errors.Is(err, models.ErrCouponNotApplicable) {
+			app.errorLog.Println(err)
+		}
+		return coupon, 0, models.ErrCouponNotApplicable
+	}
+
+	total := 0
+	for _, item := range items {
+		total += item.Total()
+	}
+	// stripe can not take a payment of nothing
+	if discount >= total {
+		return coupon, 0, errors.New("this coupon can not pay for a whole order")
+	}
+	return coupon, discount, nil
+}
+
+// CheckCoupon tells the checkout page what a coupon takes off the cart, before
+// the customer pays. The payment intent checks the coupon again.
+func (app *application) CheckCoupon(w http.ResponseWriter, r *http.Request) {
+	var payload stripePayload
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		OK       bool   `json:"ok"`
+		Message  string `json:"message"`
+		Code     string `json:"code,omitempty"`
+		Discount int    `json:"discount"`
+		Tax      int    `json:"tax"`
+		Total    int    `json:"total"`
+	}
+
+	lines, err := payloadLines(payload)
+	if err != nil {
+		resp.Message = err.Error()
+		app.writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	currency := checkoutCurrency(payload.Currency)
+	var items []models.OrderItem
+	for _, line := range lines {
+		widget, err := app.DB.GetWidget(line.WidgetID)
+		if err != nil || widget.IsRecurring {
+			resp.Message = "Invalid product"
+			app.writeJSON(w, http.StatusOK, resp)
+			return
+		}
+		price, ok := widget.PriceIn(currency)
+		if !ok {
+			resp.Message = fmt.Sprintf("%s is not sold in %s", widget.Name, strings.ToUpper(currency))
+			app.writeJSON(w, http.StatusOK, resp)
+			return
+		}
+		item := models.OrderItem{WidgetID: widget.ID, Quantity: line.Quantity, Price: price}
+		items = append(items, item)
+		resp.Total += item.Total()
+	}
+
+	coupon, discount, err := app.applyCoupon(payload.Coupon, currency, items)
+	if err != nil {
+		resp.Message = err.Error()
+		app.writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	resp.OK = true
+	resp.Code = coupon.Code
+	resp.Message = coupon.Description
+	resp.Discount = discount
+	resp.Total -= discount
+	// the buyer may not have chosen their state yet, in which case the total is before tax
+	taxLines, err := app.orderTax(currency, payload.State, resp.Total)
+	if err == nil {
+		resp.Tax = tax.Total(taxLines)
+		resp.Total += resp.Tax
+	}
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// AllCoupons returns every coupon with how often it was redeemed
+func (app *application) AllCoupons(w http.ResponseWriter, r *http.Request) {
+	coupons, err := app.DB.GetAllCoupons()
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+	app.writeJSON(w, http.StatusOK, coupons)
+}
+
+// OneCoupon returns one coupon and the orders that redeemed it
+func (app *application) OneCoupon(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	couponID, err := strconv.Atoi(id)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	coupon, err := app.DB.GetCoupon(couponID)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	redemptions, err := app.DB.GetCouponRedemptions(couponID)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		models.Coupon
+		RedemptionList []models.CouponRedemption `json:"redemption_list"`
+	}
+	resp.Coupon = coupon
+	resp.RedemptionList = redemptions
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// EditCoupon adds a coupon when id is 0 and updates it otherwise
+func (app *application) EditCoupon(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	couponID, err := strconv.Atoi(id)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var payload struct {
+		Code           string `json:"code"`
+		Description    string `json:"description"`
+		DiscountType   string `json:"discount_type"`
+		Amount         int    `json:"amount"`
+		Currency       string `json:"currency"`
+		WidgetID       int    `json:"widget_id"`
+		ExpiresAt      string `json:"expires_at"`
+		MaxRedemptions int    `json:"max_redemptions"`
+		IsActive       bool   `json:"is_active"`
+	}
+	err = app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	coupon := models.Coupon{
+		ID:             couponID,
+		Code:           strings.ToUpper(strings.TrimSpace(payload.Code)),
+		Description:    strings.TrimSpace(payload.Description),
+		DiscountType:   payload.DiscountType,
+		Amount:         payload.Amount,
+		Currency:       strings.ToLower(strings.TrimSpace(payload.Currency)),
+		WidgetID:       payload.WidgetID,
+		MaxRedemptions: payload.MaxRedemptions,
+		IsActive:       payload.IsActive,
+	}
+
+	v := validator.New()
+	v.Check(couponCode.MatchString(coupon.Code), "code", "must be 3 to 64 letters, digits, dashes or underscores")
+	v.Check(len(coupon.Description) <= 255, "description", "must be at most 255 characters")
+	v.Check(coupon.DiscountType == models.CouponPercent || coupon.DiscountType == models.CouponFixed, "discount_type", "must be percent or fixed")
+	v.Check(coupon.DiscountType != models.CouponPercent || (coupon.Amount >= 1 && coupon.Amount <= 100), "amount", "must be between 1 and 100 percent")
+	v.Check(coupon.DiscountType != models.CouponFixed || coupon.Amount > 0, "amount", "must be greater than zero")
+	v.Check(coupon.DiscountType != models.CouponFixed || len(coupon.Currency) == 3, "currency", "must be a three letter currency code")
+	v.Check(coupon.MaxRedemptions >= 0, "max_redemptions", "must not be negative")
+	if coupon.DiscountType == models.CouponPercent {
+		coupon.Currency = ""
+	}
+	if payload.ExpiresAt != "" {
+		// the coupon can be used until the end of the day it expires
+		expiresAt, err := time.ParseInLocation("2006-01-02", payload.ExpiresAt, time.Local)
+		v.Check(err == nil, "expires_at", "must be a date")
+		coupon.ExpiresAt = expiresAt.Add(24*time.Hour - time.Second)
+	}
+	if coupon.WidgetID > 0 {
+		_, err := app.DB.GetWidget(coupon.WidgetID)
+		v.Check(err == nil, "widget_id", "must be an existing widget")
+	}
+
+	if existing, err := app.DB.GetCouponByCode(coupon.Code); err == nil && existing.ID != couponID {
+		v.AddError("code", "is already used by another coupon")
+	}
+
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+		ID      int    `json:"id"`
+	}
+
+	if couponID > 0 {
+		_, err = app.DB.GetCoupon(couponID)
+		if err != nil {
+			app.errorLog.Println(err)
+			app.badRequest(w, r, err)
+			return
+		}
+		err = app.DB.EditCoupon(coupon)
+		if err != nil {
+			app.errorLog.Println(err)
+			app.badRequest(w, r, err)
+			return
+		}
+		resp.ID = couponID
+		resp.Message = "Coupon saved"
+	} else {
+		resp.ID, err = app.DB.AddCoupon(coupon)
+		if err != nil {
+			app.errorLog.Println(err)
+			app.badRequest(w, r, err)
+			return
+		}
+		resp.Message = "Coupon added"
+	}
+
+	resp.Error = false
+	app.writeJSON(w, http.StatusOK, resp)
+}
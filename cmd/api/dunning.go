@@ -0,0 +1,269 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"myapp/internal/models"
+	"myapp/internal/money"
+	"myapp/internal/urlsigner"
+	"myapp/internal/validator"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// parseDunningSchedule reads a comma separated list of days, e.g. "3,5,7"
+func parseDunningSchedule(s string) ([]int, error) {
+	var schedule []int
+	for _, x := range strings.Split(s, ",") {
+		x = strings.TrimSpace(x)
+		if x == "" {
+			continue
+		}
+		days, err := strconv.Atoi(x)
+		if err != nil || days < 1 {
+			return nil, fmt.Errorf("invalid dunning schedule %q: %q is not a number of days", s, x)
+		}
+		schedule = append(schedule, days)
+	}
+	return schedule, nil
+}
+
+// chasePastDueInvoice handles a failed renewal. Each failure schedules the
+// next retry and emails the customer a link to update their card; the failure
+// after the last retry cancels the subscription.
+func (app *application) chasePastDueInvoice(invoice stripe.Invoice) error {
+	order, err := app.DB.GetOrderByPaymentIntent(invoice.Subscription.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// cleared, trialing or already past due; paused and cancelling ones are not chased
+	if order.StatusID != 1 && order.StatusID != 6 && order.StatusID != 7 {
+		return nil
+	}
+
+	attempt := int(invoice.AttemptCount)
+	if attempt < 1 {
+		attempt = 1
+	}
+	if attempt > len(app.config.dunning) {
+		return app.cancelPastDueSubscription(order, invoice)
+	}
+
+	nextAttempt := time.Now().AddDate(0, 0, app.config.dunning[attempt-1])
+	err = app.DB.RecordPaymentFailure(order.ID, invoice.ID, attempt, nextAttempt)
+	if err != nil {
+		return err
+	}
+
+	widget, err := app.DB.GetWidget(order.WidgetID)
+	if err != nil {
+		return err
+	}
+
+	// the link signs the customer in, so it lasts until the subscription would be cancelled
+	valid := 0
+	for _, days := range app.config.dunning[attempt-1:] {
+		valid += days * 24 * 60
+	}
+	link := fmt.Sprintf("%s/account/update-card?order=%d&valid=%d", app.config.frontEnd, order.ID, valid)
+	signer := urlsigner.Signer{
+		Secret: []byte(app.config.secretKey),
+	}
+
+	var data struct {
+		FirstName   string
+		Plan        string
+		Amount      money.Money
+		NextAttempt string
+		Final       bool
+		Link        string
+	}
+	data.FirstName = order.Customer.FirstName
+	data.Plan = widget.Name
+	data.Amount = money.New(int(invoice.AmountDue), string(invoice.Currency))
+	data.NextAttempt = nextAttempt.Format("02-01-2006")
+	data.Final = attempt == len(app.config.dunning)
+	data.Link = signer.GenerateTokenFromString(link)
+
+	subject := "Your subscription payment failed"
+	if data.Final {
+		subject = "Final notice: update your card to keep your subscription"
+	} else if attempt > 1 {
+		subject = "Reminder: your subscription payment failed"
+	}
+
+	return app.SendMail("info@widgets.com", order.Customer.Email, subject, "payment-failed", data)
+}
+
+// cancelPastDueSubscription cancels a subscription whose last retry failed
+// and tells the customer
+func (app *application) cancelPastDueSubscription(order models.Order, invoice stripe.Invoice) error {
+	_, err := app.Gateway.CancelSubscriptionNow(order.Transaction.PaymentIntent)
+	if err != nil {
+		return err
+	}
+
+	// order cancelled
+	err = app.DB.UpdateOrderStatus(order.ID, 3)
+	if err != nil {
+		return err
+	}
+	err = app.DB.ResolvePastDueInvoice(invoice.ID)
+	if err != nil {
+		return err
+	}
+
+	widget, err := app.DB.GetWidget(order.WidgetID)
+	if err != nil {
+		return err
+	}
+
+	var data struct {
+		FirstName string
+		Plan      string
+		Link      string
+	}
+	data.FirstName = order.Customer.FirstName
+	data.Plan = widget.Name
+	data.Link = fmt.Sprintf("%s/plans/%d", app.config.frontEnd, widget.ID)
+
+	return app.SendMail("info@widgets.com", order.Customer.Email, "Your subscription has been cancelled", "subscription-cancelled", data)
+}
+
+// retryPastDueInvoices tries past due invoices again as their retries fall due
+func (app *application) retryPastDueInvoices() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		due, err := app.DB.GetDueInvoiceRetries(time.Now())
+		if err != nil {
+			app.errorLog.Println(err)
+			continue
+		}
+
+		for _, x := range due {
+			key := fmt.Sprintf("dunning-%s-%d", x.InvoiceID, x.Attempts)
+			_, err = app.Gateway.WithIdempotencyKey(key).PayInvoice(x.InvoiceID)
+			var stripeErr *stripe.Error
+			if err != nil && !(errors.As(err, &stripeErr) && stripeErr.Type == stripe.ErrorTypeCard) {
+				// stripe did not try the card, so the retry stays due and
+				// is sent again, with the same key, on the next tick
+				app.errorLog.Println("retry of invoice", x.InvoiceID, "not made:", err)
+				continue
+			}
+			if err != nil {
+				app.infoLog.Println("retry of invoice", x.InvoiceID, "failed:", err)
+			}
+
+			// a failure comes back as invoice.payment_failed, which schedules
+			// the next retry, and a success as invoice.paid
+			err = app.DB.ClearNextAttempt(x.InvoiceID, x.Attempts)
+			if err != nil {
+				app.errorLog.Println(err)
+			}
+		}
+	}
+}
+
+// subscriptionCardOrder checks a subscription card token signed by the front
+// end for the signed in customer and returns the order it is for
+func (app *application) subscriptionCardOrder(token string) (int, error) {
+	signer := urlsigner.Signer{
+		Secret: []byte(app.config.secretKey),
+	}
+	if !strings.HasPrefix(token, app.config.frontEnd+"/subscription-card?") || !signer.VerifyToken(token) {
+		return 0, errors.New("invalid subscription card token")
+	}
+	if signer.Expired(token, 60) {
+		return 0, errors.New("subscription card token expired")
+	}
+	u, err := url.Parse(token)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(u.Query().Get("order"))
+}
+
+// UpdateSubscriptionCard changes the card a subscription is charged to. When
+// a renewal is past due the response carries the client secret of its payment
+// intent, so the browser can pay it with the new card straight away.
+func (app *application) UpdateSubscriptionCard(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Token         string `json:"token"`
+		PaymentMethod string `json:"payment_method"`
+	}
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(payload.PaymentMethod != "", "payment_method", "must be provided")
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	orderID, err := app.subscriptionCardOrder(payload.Token)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+	order, err := app.getSubscriptionOrder(orderID)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+	// cleared, paused, trialing or past due
+	if order.StatusID != 1 && order.StatusID != 5 && order.StatusID != 6 && order.StatusID != 7 {
+		app.writeJSON(w, http.StatusOK, jsonResponse{OK: false, Message: "This subscription has ended"})
+		return
+	}
+
+	subscription, err := app.gateway(r).GetSubscription(order.Transaction.PaymentIntent)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	msg, err := app.gateway(r).AttachPaymentMethod(subscription.Customer.ID, payload.PaymentMethod)
+	if err != nil {
+		app.errorLog.Println(err)
+		if msg == "" {
+			msg = "Your card could not be saved"
+		}
+		app.writeJSON(w, http.StatusOK, jsonResponse{OK: false, Message: msg})
+		return
+	}
+	err = app.gateway(r).SetSubscriptionPaymentMethod(subscription.ID, payload.PaymentMethod)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	resp := jsonResponse{OK: true, Message: "Your card has been updated"}
+
+	invoice := subscription.LatestInvoice
+	if invoice != nil && invoice.Status == stripe.InvoiceStatusOpen && invoice.PaymentIntent != nil &&
+		invoice.PaymentIntent.Status != stripe.PaymentIntentStatusSucceeded {
+		resp.RequiresAction = true
+		resp.ClientSecret = invoice.PaymentIntent.ClientSecret
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
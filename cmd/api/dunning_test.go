@@ -0,0 +1,34 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDunningSchedule(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []int
+		wantErr bool
+	}{
+		{"3,5,7", []int{3, 5, 7}, false},
+		{" 1, 2 ", []int{1, 2}, false},
+		{"", nil, false},
+		{"3,,5", []int{3, 5}, false},
+		{"3,x", nil, true},
+		{"0", nil, true},
+		{"-2", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseDunningSchedule(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseDunningSchedule(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseDunningSchedule(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,9 +10,12 @@ import (
 	"myapp/internal/cards"
 	"myapp/internal/encryption"
 	"myapp/internal/models"
+	"myapp/internal/money"
+	"myapp/internal/tax"
 	"myapp/internal/urlsigner"
 	"myapp/internal/validator"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -32,15 +36,41 @@ type stripePayload struct {
 	LastFour      string `json:"last_four"`
 	Plan          string `json:"plan"`
 	ProductID     string `json:"product_id"`
+	Quantity      int    `json:"quantity"`
 	FirstName     string `json:"first_name"`
 	LastName      string `json:"last_name"`
+	// SubscriptionID is set when confirming a subscription after 3-D Secure
+	SubscriptionID string `json:"subscription_id"`
+	// SaveCard keeps the new card on the customer's stripe customer for next time
+	SaveCard bool `json:"save_card"`
+	// SavedCard is a token signed by the front end for a card saved before
+	SavedCard string `json:"saved_card"`
+	// CustomerToken is signed by the front end for a signed in customer
+	CustomerToken string `json:"customer_token"`
+	// Items is the cart; when it is empty ProductID and Quantity are one line
+	Items []cards.LineItem `json:"items"`
+	// Coupon is a discount code typed in at checkout
+	Coupon string `json:"coupon"`
+	// State is the GST state code of the buyer, which decides the taxes charged
+	State string `json:"state"`
+	// ManualCapture only places a hold on the card in the virtual terminal,
+	// to be captured or voided from the sale page later
+	ManualCapture bool `json:"manual_capture"`
 }
 
+// maxCartLines keeps the items metadata within stripe's 500 character limit
+const maxCartLines = 50
+
 type jsonResponse struct {
 	OK      bool   `json:"ok"`
 	Message string `json:"message,omitempty"`
 	Content string `json:"content,omitempty"`
 	ID      int    `json:"id,omitempty"`
+	// RequiresAction asks the browser to confirm ClientSecret with stripe.js
+	// and then finish the subscription with SubscriptionID
+	RequiresAction bool   `json:"requires_action,omitempty"`
+	ClientSecret   string `json:"client_secret,omitempty"`
+	SubscriptionID string `json:"subscription_id,omitempty"`
 }
 
 func (app *application) GetPaymentIntent(w http.ResponseWriter, r *http.Request) {
@@ -52,49 +82,367 @@ func (app *application) GetPaymentIntent(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	amount, err := strconv.Atoi(payload.Amount)
+	lines, err := payloadLines(payload)
 	if err != nil {
-		app.errorLog.Println(err)
+		app.writePaymentIntentError(w, err.Error())
 		return
 	}
 
-	card := cards.Card{
-		Secret:   app.config.stripe.secret,
-		Key:      app.config.stripe.key,
-		Currency: payload.Currency,
+	// the price always comes from the database, never from the browser
+	currency := checkoutCurrency(payload.Currency)
+	amount := 0
+	var names []string
+	var reserve []models.OrderItem
+	for i, line := range lines {
+		widget, err := app.DB.GetWidget(line.WidgetID)
+		if err != nil {
+			app.errorLog.Println(err)
+			app.writePaymentIntentError(w, "Invalid product")
+			return
+		}
+		if widget.IsRecurring {
+			app.writePaymentIntentError(w, fmt.Sprintf("%s is a subscription and cannot be bought once", widget.Name))
+			return
+		}
+		if !widget.IsActive {
+			app.writePaymentIntentError(w, fmt.Sprintf("%s is no longer available", widget.Name))
+			return
+		}
+
+		// check stock before asking stripe for anything; ReserveStock checks again under lock
+		available, err := app.DB.GetAvailableStock(widget.ID)
+		if err != nil {
+			app.errorLog.Println(err)
+			app.writePaymentIntentError(w, "Invalid product")
+			return
+		}
+		if available < line.Quantity {
+			outOfStock := models.OutOfStockError{WidgetID: widget.ID, Name: widget.Name, Available: available}
+			app.writePaymentIntentError(w, outOfStock.Error())
+			return
+		}
+
+		price, ok := widget.PriceIn(currency)
+		if !ok {
+			app.writePaymentIntentError(w, fmt.Sprintf("%s is not sold in %s", widget.Name, strings.ToUpper(currency)))
+			return
+		}
+
+		// the price is kept on the payment intent, so a later price change
+		// does not stop the order being recorded
+		lines[i].Price = price
+		amount += price * line.Quantity
+		names = append(names, widget.Name)
+		reserve = append(reserve, models.OrderItem{WidgetID: widget.ID, Quantity: line.Quantity, Price: price})
 	}
 
-	okay := true
+	// the discount is worked out here as well, never taken from the browser
+	var coupon models.Coupon
+	discount := 0
+	if strings.TrimSpace(payload.Coupon) != "" {
+		coupon, discount, err = app.applyCoupon(payload.Coupon, currency, reserve)
+		if err != nil {
+			app.writePaymentIntentError(w, err.Error())
+			return
+		}
+		amount -= discount
+	}
 
-	pi, msg, err := card.Charge(payload.Currency, amount)
+	// GST is charged on the discounted price
+	taxLines, err := app.orderTax(currency, payload.State, amount)
 	if err != nil {
-		okay = false
+		app.writePaymentIntentError(w, err.Error())
+		return
 	}
+	amount += tax.Total(taxLines)
 
-	if okay {
-		out, err := json.MarshalIndent(pi, "", "   ")
+	metadata := map[string]string{
+		"items":       cards.EncodeLineItems(lines),
+		"order_total": strconv.Itoa(amount),
+	}
+	if discount > 0 {
+		metadata["coupon"] = coupon.Code
+		metadata["coupon_id"] = strconv.Itoa(coupon.ID)
+		metadata["discount"] = strconv.Itoa(discount)
+	}
+	if len(taxLines) > 0 {
+		metadata["tax"] = tax.EncodeLines(taxLines)
+		metadata["tax_state"] = payload.State
+		// the invoice is checked against the state the tax was split from
+		metadata["tax_seller_state"] = app.config.tax.SellerState
+	}
+	if len(lines) == 1 {
+		metadata["widget_id"] = strconv.Itoa(lines[0].WidgetID)
+		metadata["widget_name"] = names[0]
+		metadata["quantity"] = strconv.Itoa(lines[0].Quantity)
+	}
+
+	// a saved card is charged off session on the stripe customer it belongs
+	// to; a new card is saved to a signed in customer's stripe customer, or
+	// to a new one for anyone else
+	var customerID, savedPM string
+	if payload.SavedCard != "" {
+		savedPM, err = app.savedCardPaymentMethod(payload.SavedCard)
+		if err != nil {
+			app.errorLog.Println(err)
+			app.writePaymentIntentError(w, "Please enter your card again")
+			return
+		}
+		pm, err := app.gateway(r).GetPaymentMethod(savedPM)
+		if err != nil || pm.Customer == nil {
+			app.errorLog.Println("saved card not attached", savedPM, err)
+			app.writePaymentIntentError(w, "Please enter your card again")
+			return
+		}
+		customerID = pm.Customer.ID
+	} else if payload.SaveCard && payload.Email != "" {
+		cust, msg, err := app.gateway(r).GetOrCreateCustomer(app.signedInStripeCustomer(payload.CustomerToken, payload.Email), "", payload.Email)
 		if err != nil {
 			app.errorLog.Println(err)
+			app.writePaymentIntentError(w, msg)
 			return
 		}
+		customerID = cust.ID
+	}
+
+	app.createPaymentIntent(w, r, currency, amount, metadata, reserve, customerID, savedPM)
+}
+
+// checkoutCurrency returns the lower case currency a customer chose to pay
+// in, or money.DefaultCurrency when they did not choose one
+func checkoutCurrency(currency string) string {
+	return money.New(0, currency).Currency
+}
+
+// orderTax returns the GST on a taxable amount paid in currency by a buyer in
+// state. Only one time purchases in rupees are taxed; subscriptions are sold
+// without GST, as stripe bills their renewals without tax rates. The error is
+// shown to the customer.
+func (app *application) orderTax(currency, state string, taxable int) ([]tax.Line, error) {
+	if !app.config.tax.Enabled() || !strings.EqualFold(currency, "inr") {
+		return nil, nil
+	}
+	if _, ok := tax.LookupState(state); !ok {
+		return nil, errors.New("Please choose your state")
+	}
+	return app.config.tax.Lines(taxable, state)
+}
+
+// payloadLines returns the cart lines of a checkout, with repeated widgets
+// merged into one line. The error is shown to the customer.
+func payloadLines(payload stripePayload) ([]cards.LineItem, error) {
+	items := payload.Items
+	if len(items) == 0 {
+		widgetID, err := strconv.Atoi(payload.ProductID)
+		if err != nil {
+			return nil, errors.New("Invalid product")
+		}
+		quantity := payload.Quantity
+		if quantity == 0 {
+			quantity = 1
+		}
+		items = []cards.LineItem{{WidgetID: widgetID, Quantity: quantity}}
+	}
+	if len(items) > maxCartLines {
+		return nil, fmt.Errorf("A cart can have at most %d items", maxCartLines)
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(out)
+	var lines []cards.LineItem
+	index := make(map[int]int)
+	for _, item := range items {
+		if item.Quantity < 1 {
+			return nil, errors.New("Invalid quantity")
+		}
+		if i, ok := index[item.WidgetID]; ok {
+			lines[i].Quantity += item.Quantity
+			continue
+		}
+		index[item.WidgetID] = len(lines)
+		lines = append(lines, item)
+	}
+	return lines, nil
+}
+
+// signedIn checks a customer token signed by the front end and reports
+// whether it is for the customer signed in with email
+func (app *application) signedIn(token, email string) bool {
+	signer := urlsigner.Signer{
+		Secret: []byte(app.config.secretKey),
+	}
+	if token == "" || !strings.HasPrefix(token, app.config.frontEnd+"/customer?") || !signer.VerifyToken(token) {
+		return false
+	}
+	if signer.Expired(token, 60) {
+		return false
+	}
+	u, err := url.Parse(token)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Query().Get("email"), strings.TrimSpace(email))
+}
+
+// signedInStripeCustomer returns the stripe customer of the customer signed in
+// with email, and "" for anyone else or a customer without one
+func (app *application) signedInStripeCustomer(token, email string) string {
+	if !app.signedIn(token, email) {
+		return ""
+	}
+	customer, err := app.DB.GetCustomerByEmail(email)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			app.errorLog.Println(err)
+		}
+		return ""
+	}
+	return customer.StripeCustomerID
+}
+
+// savedCardPaymentMethod checks a saved card token signed by the front end
+// and returns the payment method it is for
+func (app *application) savedCardPaymentMethod(token string) (string, error) {
+	signer := urlsigner.Signer{
+		Secret: []byte(app.config.secretKey),
+	}
+	if !strings.HasPrefix(token, app.config.frontEnd+"/saved-card?") || !signer.VerifyToken(token) {
+		return "", errors.New("invalid saved card token")
+	}
+	if signer.Expired(token, 60) {
+		return "", errors.New("saved card token expired")
+	}
+	u, err := url.Parse(token)
+	if err != nil {
+		return "", err
+	}
+	pm := u.Query().Get("pm")
+	if pm == "" {
+		return "", errors.New("saved card token has no payment method")
+	}
+	return pm, nil
+}
+
+// VirtualTerminalPaymentIntent creates a payment intent for the amount an admin keyed into the virtual terminal
+func (app *application) VirtualTerminalPaymentIntent(w http.ResponseWriter, r *http.Request) {
+	var payload stripePayload
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	amount, err := strconv.Atoi(payload.Amount)
+	if err != nil || amount <= 0 {
+		app.writePaymentIntentError(w, "Invalid amount")
+		return
+	}
+
+	currency := checkoutCurrency(payload.Currency)
+	metadata := map[string]string{"source": "virtual_terminal"}
+	if payload.ManualCapture {
+		metadata["capture"] = "manual"
+		pi, msg, err := app.gateway(r).AuthorizePaymentIntent(currency, amount, metadata)
+		if err != nil {
+			app.errorLog.Println(err)
+			app.writePaymentIntentError(w, msg)
+			return
+		}
+		app.writeJSON(w, http.StatusOK, pi)
+		return
+	}
+
+	app.createPaymentIntent(w, r, currency, amount, metadata, nil, "", "")
+}
+
+// createPaymentIntent creates a payment intent, reserves stock for items and
+// the coupon in metadata, and writes the intent, or the card, stock or coupon
+// error, as JSON. With a customerID the card is saved to that stripe customer,
+// and with a savedPM the intent is charged to that saved card straight away.
+func (app *application) createPaymentIntent(w http.ResponseWriter, r *http.Request, currency string, amount int, metadata map[string]string, items []models.OrderItem, customerID, savedPM string) {
+	okay := true
+
+	var pi *stripe.PaymentIntent
+	var msg string
+	var err error
+	if customerID != "" {
+		pi, msg, err = app.gateway(r).CreateCustomerPaymentIntent(customerID, currency, amount, metadata)
 	} else {
-		j := jsonResponse{
-			OK:      false,
-			Message: msg,
-			Content: "",
+		pi, msg, err = app.gateway(r).CreatePaymentIntent(currency, amount, metadata)
+	}
+	if err != nil {
+		app.errorLog.Println(err)
+		okay = false
+	}
+
+	if okay && len(items) > 0 {
+		// the coupon id was put in the metadata by GetPaymentIntent
+		couponID, _ := strconv.Atoi(metadata["coupon_id"])
+		err = app.DB.ReserveStock(pi.ID, items, couponID)
+		if err != nil {
+			app.errorLog.Println(err)
+			okay = false
+			msg = "Unable to reserve stock"
+			var outOfStock *models.OutOfStockError
+			if errors.As(err, &outOfStock) {
+				msg = outOfStock.Error()
+			} else if errors.Is(err, models.ErrCouponUsedUp) {
+				msg = err.Error()
+			}
+			// nobody can pay for stock we could not reserve
+			if err := app.gateway(r).CancelPaymentIntent(pi.ID); err != nil {
+				app.errorLog.Println(err)
+			}
+		}
+	}
+
+	// stock is reserved before the saved card is charged
+	if okay && savedPM != "" {
+		charged, chargeMsg, err := app.gateway(r).ChargeSavedCard(pi.ID, savedPM)
+		if err != nil && charged == nil {
+			app.errorLog.Println(err)
+			okay = false
+			msg = chargeMsg
+			if err := app.gateway(r).CancelPaymentIntent(pi.ID); err != nil {
+				app.errorLog.Println(err)
+			}
+			if err := app.DB.ReleaseStock(pi.ID); err != nil {
+				app.errorLog.Println(err)
+			}
+		} else {
+			// when the bank wants authentication the customer confirms the
+			// returned intent on session
+			pi = charged
 		}
+	}
 
-		out, err := json.MarshalIndent(j, "", "   ")
+	if okay {
+		out, err := json.MarshalIndent(pi, "", "   ")
 		if err != nil {
 			app.errorLog.Println(err)
+			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		w.Write(out)
+	} else {
+		app.writePaymentIntentError(w, msg)
+	}
+}
+
+func (app *application) writePaymentIntentError(w http.ResponseWriter, msg string) {
+	j := jsonResponse{
+		OK:      false,
+		Message: msg,
+		Content: "",
 	}
+
+	out, err := json.MarshalIndent(j, "", "   ")
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
 }
 
 // GetWidgetByID gets one widget by id and returns as JSON
@@ -108,6 +456,12 @@ func (app *application) GetWidgetByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	widget.Available, err = app.DB.GetAvailableStock(widget.ID)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
 	out, err := json.MarshalIndent(widget, "", "   ")
 	if err != nil {
 		app.errorLog.Println(err)
@@ -123,6 +477,7 @@ type Invoice struct {
 	ID        int       `json:"id"`
 	Quantity  int       `json:"quantity"`
 	Amount    int       `json:"amount"`
+	Currency  string    `json:"currency"`
 	Product   string    `json:"product"`
 	FirstName string    `json:"first_name"`
 	LastName  string    `json:"last_name"`
@@ -148,81 +503,259 @@ func (app *application) CreateCustomerAndSubscribeToPlan(w http.ResponseWriter,
 		return
 	}
 
-	card := cards.Card{
-		Secret:   app.config.stripe.secret,
-		Key:      app.config.stripe.key,
-		Currency: data.Currency,
-	}
-
 	okay := true
 	var subscription *stripe.Subscription
 	txnMsg := "Transaction successful"
 
-	stripeCustomer, msg, err := card.CreateCustomer(data.PaymentMethod, data.Email)
-	if err != nil {
-		app.errorLog.Println(err)
+	// plan and price come from the widget, not from the browser
+	productID, _ := strconv.Atoi(data.ProductID)
+	widget, err := app.DB.GetWidget(productID)
+	if err != nil || !widget.IsRecurring || !widget.IsActive {
+		app.errorLog.Println("invalid plan", productID, err)
 		okay = false
-		txnMsg = msg
+		txnMsg = "Invalid plan"
 	}
 
+	var stripeCustomer *stripe.Customer
 	if okay {
-		subscription, err = card.SubscribeToPlan(stripeCustomer, data.Plan, data.Email, data.LastFour, "")
+		// bill signed in customers to the stripe customer they already have;
+		// anyone else gets a new one, whatever email they type
+		var msg string
+		stripeCustomer, msg, err = app.gateway(r).GetOrCreateCustomer(app.signedInStripeCustomer(data.CustomerToken, data.Email), data.PaymentMethod, data.Email)
 		if err != nil {
 			app.errorLog.Println(err)
 			okay = false
-			txnMsg = "Error subscribing customer"
+			txnMsg = msg
 		}
-		app.infoLog.Println("subscription id is", subscription.ID)
 	}
 
 	if okay {
-		productID, _ := strconv.Atoi(data.ProductID)
-		customerID, err := app.SaveCustomer(data.FirstName, data.LastName, data.Email)
+		subscription, err = app.gateway(r).SubscribeToPlan(stripeCustomer, widget.PlanID, data.Email, data.LastFour, "", widget.TrialDays)
 		if err != nil {
 			app.errorLog.Println(err)
-			return
+			okay = false
+			txnMsg = "Error subscribing customer"
+		} else {
+			app.infoLog.Println("subscription id is", subscription.ID)
 		}
+	}
 
-		// create a new txn
-		amount, _ := strconv.Atoi(data.Amount)
-		txn := models.Transaction{
-			Amount:              amount,
-			Currency:            "inr",
-			LastFour:            data.LastFour,
-			ExpiryMonth:         data.ExpiryMonth,
-			ExpiryYear:          data.ExpiryYear,
-			TransactionStatusID: 2,
-			PaymentIntent:       subscription.ID,
-			PaymentMethod:       data.PaymentMethod,
+	// the first payment needs 3-D Secure; the order is only saved by
+	// ConfirmSubscription once the customer has authenticated it
+	if okay && subscription.LatestInvoice != nil && subscription.LatestInvoice.PaymentIntent != nil {
+		pi := subscription.LatestInvoice.PaymentIntent
+		switch pi.Status {
+		case stripe.PaymentIntentStatusRequiresAction, stripe.PaymentIntentStatusRequiresConfirmation:
+			resp := jsonResponse{
+				OK:             false,
+				Message:        "Your bank needs you to authenticate this payment",
+				RequiresAction: true,
+				ClientSecret:   pi.ClientSecret,
+				SubscriptionID: subscription.ID,
+			}
+			app.writeJSON(w, http.StatusOK, resp)
+			return
+		case stripe.PaymentIntentStatusRequiresPaymentMethod:
+			// stripe expires the incomplete subscription by itself
+			okay = false
+			txnMsg = "Your card was declined"
 		}
+	}
 
-		txnID, err := app.SaveTransaction(txn)
+	if okay {
+		txnMsg, err = app.saveSubscriptionOrder(data, widget, subscription)
 		if err != nil {
 			app.errorLog.Println(err)
 			return
 		}
+	}
 
-		// create order
-		order := models.Order{
-			WidgetID:      productID,
-			TransactionID: txnID,
-			CustomerID:    customerID,
-			StatusID:      1,
-			Quantity:      1,
-			Amount:        amount,
-			CreatedAt:     time.Now(),
-			UpdatedAt:     time.Now(),
-		}
+	resp := jsonResponse{
+		OK:      okay,
+		Message: txnMsg,
+	}
 
-		orderId, err := app.SaveOrder(order)
-		if err != nil {
-			app.errorLog.Println(err)
-			return
+	out, err := json.MarshalIndent(resp, "", "  ")
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
+
+// ConfirmSubscription saves the order for a subscription whose first payment
+// needed 3-D Secure, once stripe reports that the payment succeeded
+func (app *application) ConfirmSubscription(w http.ResponseWriter, r *http.Request) {
+	var data stripePayload
+	err := app.readJSON(w, r, &data)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(len(data.FirstName) > 1, "first_name", "must be atleast 2 characters")
+	v.Check(len(data.LastName) > 1, "last_name", "must be atleast 2 characters")
+	v.Check(data.SubscriptionID != "", "subscription_id", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	productID, _ := strconv.Atoi(data.ProductID)
+	widget, err := app.DB.GetWidget(productID)
+	if err != nil || !widget.IsRecurring || !widget.IsActive {
+		app.errorLog.Println("invalid plan", productID, err)
+		app.writeJSON(w, http.StatusOK, jsonResponse{OK: false, Message: "Invalid plan"})
+		return
+	}
+
+	// a second submit after the order was saved is not an error
+	_, err = app.DB.GetOrderByPaymentIntent(data.SubscriptionID)
+	if err == nil {
+		app.writeJSON(w, http.StatusOK, jsonResponse{OK: true, Message: "Transaction successful"})
+		return
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	subscription, err := app.gateway(r).GetSubscription(data.SubscriptionID)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	// anyone can post a subscription id, so it is only recorded for the
+	// customer it was created for
+	if !app.subscriptionBelongsTo(subscription, data.CustomerToken, data.Email) {
+		app.errorLog.Println("subscription", subscription.ID, "does not belong to", data.Email)
+		app.writeJSON(w, http.StatusOK, jsonResponse{OK: false, Message: "Invalid subscription"})
+		return
+	}
+
+	// trust stripe's view of the payment, not the browser's
+	var pi *stripe.PaymentIntent
+	if subscription.LatestInvoice != nil {
+		pi = subscription.LatestInvoice.PaymentIntent
+	}
+	if !subscriptionHasPlan(subscription, widget.PlanID) || pi == nil || pi.Status != stripe.PaymentIntentStatusSucceeded {
+		app.writeJSON(w, http.StatusOK, jsonResponse{OK: false, Message: "The payment was not completed"})
+		return
+	}
+
+	txnMsg, err := app.saveSubscriptionOrder(data, widget, subscription)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, jsonResponse{OK: true, Message: txnMsg})
+}
+
+// subscriptionBelongsTo reports whether the subscription was created for the
+// buyer who submitted email: a signed in customer's own stripe customer, or
+// for anyone else the new stripe customer made with that email
+func (app *application) subscriptionBelongsTo(subscription *stripe.Subscription, token, email string) bool {
+	if subscription.Customer == nil {
+		return false
+	}
+	if stripeCustomer := app.signedInStripeCustomer(token, email); stripeCustomer != "" {
+		return subscription.Customer.ID == stripeCustomer
+	}
+	return subscription.Customer.Email != "" && strings.EqualFold(subscription.Customer.Email, strings.TrimSpace(email))
+}
+
+// subscriptionHasPlan reports whether the subscription is for the given plan
+func subscriptionHasPlan(subscription *stripe.Subscription, plan string) bool {
+	if subscription.Items == nil {
+		return false
+	}
+	for _, item := range subscription.Items.Data {
+		if item.Price != nil && item.Price.ID == plan {
+			return true
+		}
+		if item.Plan != nil && item.Plan.ID == plan {
+			return true
 		}
+	}
+	return false
+}
+
+// saveSubscriptionOrder records the customer, transaction and order for a
+// subscription stripe has accepted and sends the invoice. It returns the
+// message to show the customer.
+func (app *application) saveSubscriptionOrder(data stripePayload, widget models.Widget, subscription *stripe.Subscription) (string, error) {
+	customer := models.Customer{
+		FirstName: data.FirstName,
+		LastName:  data.LastName,
+		Email:     data.Email,
+		SignedIn:  app.signedIn(data.CustomerToken, data.Email),
+	}
+	if subscription.Customer != nil {
+		customer.StripeCustomerID = subscription.Customer.ID
+	}
+
+	txnMsg := "Transaction successful"
+
+	// a trial is not charged until it ends, so the transaction stays
+	// pending and the order trialing until stripe reports the first payment
+	txnStatus, orderStatus := 2, 1
+	trialing := subscription.Status == stripe.SubscriptionStatusTrialing
+	if trialing {
+		txnStatus, orderStatus = 1, 6
+		txnMsg = fmt.Sprintf("Your %d day free trial has started", widget.TrialDays)
+	}
+
+	// create a new txn; the card stays attached to the stripe customer to pay
+	// the invoices. Subscriptions carry no GST, see orderTax.
+	amount, currency := subscriptionAmount(subscription, widget)
+	charged := amount
+	if trialing {
+		// invoice.paid records the amount when the trial is first charged
+		charged = 0
+	}
+	txn := models.Transaction{
+		Amount:              charged,
+		Currency:            currency,
+		LastFour:            data.LastFour,
+		ExpiryMonth:         data.ExpiryMonth,
+		ExpiryYear:          data.ExpiryYear,
+		TransactionStatusID: txnStatus,
+		PaymentIntent:       subscription.ID,
+		PaymentMethod:       data.PaymentMethod,
+		CardBrand:           data.CardBrand,
+	}
+
+	// create order
+	order := models.Order{
+		WidgetID:  widget.ID,
+		StatusID:  orderStatus,
+		Quantity:  1,
+		Amount:    amount,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+
+	// customer, transaction and order are saved together or not at all
+	orderId, err := app.DB.CreateOrderWithPayment(customer, txn, order)
+	if err != nil {
+		return "", err
+	}
+	// nothing has been charged yet during a trial
+	if !trialing {
 		inv := Invoice{
 			ID:        orderId,
 			Amount:    amount,
-			Product:   "Bronze Plan monthly subscription",
+			Currency:  currency,
+			Product:   fmt.Sprintf("%s subscription", widget.Name),
 			Quantity:  order.Quantity,
 			FirstName: data.FirstName,
 			LastName:  data.LastName,
@@ -231,25 +764,26 @@ func (app *application) CreateCustomerAndSubscribeToPlan(w http.ResponseWriter,
 		}
 		err = app.callInvoiceMicro(inv)
 		if err != nil {
-			app.errorLog.Println(err)
-			return
+			return "", err
 		}
 	}
+	return txnMsg, nil
+}
 
-	resp := jsonResponse{
-		OK:      okay,
-		Message: txnMsg,
-	}
-
-	out, err := json.MarshalIndent(resp, "", "  ")
-	if err != nil {
-		app.errorLog.Println(err)
-		return
+// subscriptionAmount returns what stripe charges for each period of the
+// subscription and in which currency, which is the plan's price rather than
+// the widget's
+func subscriptionAmount(subscription *stripe.Subscription, widget models.Widget) (int, string) {
+	if subscription.Items != nil {
+		for _, item := range subscription.Items.Data {
+			if item.Price != nil && item.Price.Currency != "" {
+				return int(item.Price.UnitAmount * item.Quantity), string(item.Price.Currency)
+			}
+		}
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(out)
+	return widget.Price, money.DefaultCurrency
 }
+
 func (app *application) callInvoiceMicro(inv Invoice) error {
 
 	url := "http://localhost:5000/invoice/create-and-send"
@@ -276,21 +810,6 @@ func (app *application) callInvoiceMicro(inv Invoice) error {
 
 }
 
-// SaveCustomer saves a customer and returns id
-func (app *application) SaveCustomer(firstName, lastName, email string) (int, error) {
-	customer := models.Customer{
-		FirstName: firstName,
-		LastName:  lastName,
-		Email:     email,
-	}
-
-	id, err := app.DB.InsertCustomer(customer)
-	if err != nil {
-		return 0, err
-	}
-	return id, nil
-}
-
 // SaveTransaction saves a txn and returns id
 func (app *application) SaveTransaction(txn models.Transaction) (int, error) {
 	id, err := app.DB.InsertTransaction(txn)
@@ -300,15 +819,6 @@ func (app *application) SaveTransaction(txn models.Transaction) (int, error) {
 	return id, nil
 }
 
-// SaveOrder saves a order and returns id
-func (app *application) SaveOrder(order models.Order) (int, error) {
-	id, err := app.DB.InsertOrder(order)
-	if err != nil {
-		return 0, err
-	}
-	return id, nil
-}
-
 func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request) {
 	var userInput struct {
 		Email    string `json:"email"`
@@ -433,18 +943,18 @@ func (app *application) VirtualTerminalPaymentSucceeded(w http.ResponseWriter, r
 		return
 	}
 
-	card := cards.Card{
-		Secret: app.config.stripe.secret,
-		Key:    app.config.stripe.key,
-	}
-
-	pi, err := card.RetrievePaymentIntent(txnData.PaymentIntent)
+	pi, err := app.gateway(r).RetrievePaymentIntent(txnData.PaymentIntent)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
 	}
+	// only a payment, or a hold to capture later, is recorded as a sale
+	if pi.Status != stripe.PaymentIntentStatusSucceeded && pi.Status != stripe.PaymentIntentStatusRequiresCapture {
+		app.badRequest(w, r, fmt.Errorf("payment intent %s has status %s", pi.ID, pi.Status))
+		return
+	}
 
-	pm, err := card.GetPaymentMethod(txnData.PaymentMethod)
+	pm, err := app.gateway(r).GetPaymentMethod(txnData.PaymentMethod)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
@@ -454,6 +964,9 @@ func (app *application) VirtualTerminalPaymentSucceeded(w http.ResponseWriter, r
 	txnData.ExpiryMonth = int(pm.Card.ExpMonth)
 	txnData.ExpiryYear = int(pm.Card.ExpYear)
 
+	txnData.PaymentAmount = int(pi.Amount)
+	txnData.PaymentCurrency = pi.Currency
+
 	txn := models.Transaction{
 		Amount:              txnData.PaymentAmount,
 		Currency:            txnData.PaymentCurrency,
@@ -462,19 +975,82 @@ func (app *application) VirtualTerminalPaymentSucceeded(w http.ResponseWriter, r
 		ExpiryYear:          txnData.ExpiryYear,
 		PaymentIntent:       txnData.PaymentIntent,
 		PaymentMethod:       txnData.PaymentMethod,
-		BankReturnCode:      pi.Charges.Data[0].ID,
+		BankReturnCode:      cards.ChargeID(pi),
 		TransactionStatusID: 2,
 	}
+	// an authorization has only placed a hold, which is captured or voided later
+	if pi.Status == stripe.PaymentIntentStatusRequiresCapture {
+		txn.Amount = 0
+		txn.AuthorizedAmount = int(pi.AmountCapturable)
+		txn.CaptureBefore = time.Now().Add(models.AuthorizationHold)
+		txn.TransactionStatusID = 6
+	}
 
-	_, err = app.SaveTransaction(txn)
+	txn.ID, err = app.SaveTransaction(txn)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, txn)
+	app.writeJSON(w, http.StatusOK, txn)
+}
+func (app *application) SendPasswordResetEmail(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	//verify that email exists
+	_, err = app.DB.GetUserByEmail(payload.Email)
+	if err != nil {
+		var resp struct {
+			Error   bool   `json:"error"`
+			Message string `json:"message"`
+		}
+		resp.Error = true
+		resp.Message = "No Matching email found on our system"
+
+		app.writeJSON(w, http.StatusAccepted, resp)
+		return
+	}
+
+	link := fmt.Sprintf("%s/reset-password?email=%s", app.config.frontEnd, payload.Email)
+
+	sign := urlsigner.Signer{
+		Secret: []byte(app.config.secretKey),
+	}
+	signedLink := sign.GenerateTokenFromString(link)
+
+	var data struct {
+		Link string
+	}
+	data.Link = signedLink
+
+	//send mail
+	err = app.SendMail("info@widget.com", payload.Email, "Password Reset Request", "password-reset", data)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	resp.Error = false
+
+	app.writeJSON(w, http.StatusCreated, resp)
+
 }
-func (app *application) SendPasswordResetEmail(w http.ResponseWriter, r *http.Request) {
+
+// SendCustomerLoginLink emails a customer a signed link into their account.
+// The response is the same whether or not the email is known, so it can not
+// be used to find out who has bought from us.
+func (app *application) SendCustomerLoginLink(w http.ResponseWriter, r *http.Request) {
 	var payload struct {
 		Email string `json:"email"`
 	}
@@ -484,48 +1060,54 @@ func (app *application) SendPasswordResetEmail(w http.ResponseWriter, r *http.Re
 		app.badRequest(w, r, err)
 		return
 	}
-	//verify that email exists
-	_, err = app.DB.GetUserByEmail(payload.Email)
+	payload.Email = strings.TrimSpace(payload.Email)
+
+	v := validator.New()
+	v.Check(strings.Contains(payload.Email, "@"), "email", "must be a valid email address")
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	resp.Error = false
+	resp.Message = "If we have orders for that email, a sign in link is on its way"
+
+	customer, err := app.DB.GetCustomerByEmail(payload.Email)
 	if err != nil {
-		var resp struct {
-			Error   bool   `json:"error"`
-			Message string `json:"message"`
+		if !errors.Is(err, sql.ErrNoRows) {
+			app.errorLog.Println(err)
 		}
-		resp.Error = true
-		resp.Message = "No Matching email found on our system"
-
-		app.writeJSON(w, http.StatusAccepted, resp)
+		app.writeJSON(w, http.StatusCreated, resp)
 		return
 	}
 
-	link := fmt.Sprintf("%s/reset-password?email=%s", app.config.frontEnd, payload.Email)
+	link := fmt.Sprintf("%s/account/verify?email=%s", app.config.frontEnd, url.QueryEscape(customer.Email))
 
 	sign := urlsigner.Signer{
 		Secret: []byte(app.config.secretKey),
 	}
-	signedLink := sign.GenerateTokenFromString(link)
 
 	var data struct {
-		Link string
+		FirstName string
+		Link      string
 	}
-	data.Link = signedLink
+	data.FirstName = customer.FirstName
+	data.Link = sign.GenerateTokenFromString(link)
 
-	//send mail
-	err = app.SendMail("info@widget.com", payload.Email, "Password Reset Request", "password-reset", data)
+	err = app.SendMail("info@widget.com", customer.Email, "Sign in to your account", "customer-login", data)
 	if err != nil {
 		app.errorLog.Println(err)
 		app.badRequest(w, r, err)
 		return
 	}
-	var resp struct {
-		Error   bool   `json:"error"`
-		Message string `json:"message"`
-	}
-	resp.Error = false
 
 	app.writeJSON(w, http.StatusCreated, resp)
-
 }
+
 func (app *application) ResetPassword(w http.ResponseWriter, r *http.Request) {
 	var payload struct {
 		Email    string `json:"email"`
@@ -646,6 +1228,17 @@ func (app *application) AllSubscriptions(w http.ResponseWriter, r *http.Request)
 	app.writeJSON(w, http.StatusCreated, resp)
 }
 
+// Revenue returns the takings in each currency customers have paid in
+func (app *application) Revenue(w http.ResponseWriter, r *http.Request) {
+	revenue, err := app.DB.GetRevenueByCurrency()
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+	app.writeJSON(w, http.StatusOK, revenue)
+}
+
 func (app *application) GetSale(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	orderId, err := strconv.Atoi(id)
@@ -670,6 +1263,7 @@ func (app *application) RefundCharge(w http.ResponseWriter, r *http.Request) {
 		PaymentIntent string `json:"pi"`
 		Amount        int    `json:"amount"`
 		Currency      string `json:"currency"`
+		Reason        string `json:"reason"`
 	}
 
 	err := app.readJSON(w, r, &chargeToRefund)
@@ -679,22 +1273,43 @@ func (app *application) RefundCharge(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//validate
-	card := cards.Card{
-		Secret:   app.config.stripe.secret,
-		Key:      app.config.stripe.key,
-		Currency: chargeToRefund.Currency,
+	user, err := app.authenticateToken(r)
+	if err != nil {
+		app.invalidCredentials(w)
+		return
+	}
+
+	// the payment intent and the balance come from the database, not the browser
+	order, err := app.DB.GetOrderById(chargeToRefund.ID)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(chargeToRefund.Amount > 0, "amount", "must be greater than zero")
+	v.Check(chargeToRefund.Amount <= order.Refundable(), "amount", fmt.Sprintf("must not be more than the refundable balance of %s", money.New(order.Refundable(), order.Transaction.Currency)))
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
 	}
 
-	err = card.Refund(chargeToRefund.PaymentIntent, chargeToRefund.Amount)
+	rf, err := app.gateway(r).Refund(order.Transaction.PaymentIntent, chargeToRefund.Amount, chargeToRefund.Reason)
 	if err != nil {
 		app.errorLog.Println(err)
 		app.badRequest(w, r, err)
 		return
 	}
 
-	//update status in db
-	err = app.DB.UpdateOrderStatus(chargeToRefund.ID, 2)
+	//record the refund, and update status in db
+	err = app.DB.RecordRefund(models.Refund{
+		OrderID:        order.ID,
+		Amount:         int(rf.Amount),
+		Reason:         chargeToRefund.Reason,
+		StripeRefundID: rf.ID,
+		RefundedBy:     user.Email,
+	})
 	if err != nil {
 		app.errorLog.Println(err)
 		app.badRequest(w, r, errors.New("the charge was refunded, but the database could not be updated"))
@@ -706,16 +1321,51 @@ func (app *application) RefundCharge(w http.ResponseWriter, r *http.Request) {
 	}
 	resp.Error = false
 	resp.Message = "Charge Refunded"
+	if int(rf.Amount) < order.Refundable() {
+		resp.Message = "Charge Partially Refunded"
+	}
 
 	app.writeJSON(w, http.StatusCreated, resp)
 }
 
+// getSubscriptionOrder loads an order and checks that it is for a subscription
+func (app *application) getSubscriptionOrder(id int) (models.Order, error) {
+	order, err := app.DB.GetOrderById(id)
+	if err != nil {
+		return order, err
+	}
+	widget, err := app.DB.GetWidget(order.WidgetID)
+	if err != nil {
+		return order, err
+	}
+	if !widget.IsRecurring {
+		return order, fmt.Errorf("order %d is not a subscription", id)
+	}
+	return order, nil
+}
+
+// proratedRefund returns the part of amount paid for the time left in the
+// period from periodStart to periodEnd, all in unix seconds
+func proratedRefund(amount int, periodStart, periodEnd, now int64) int {
+	if periodEnd <= periodStart || now >= periodEnd {
+		return 0
+	}
+	if now < periodStart {
+		now = periodStart
+	}
+	return int(int64(amount) * (periodEnd - now) / (periodEnd - periodStart))
+}
+
+// CancelSubscription cancels a subscription at the end of the paid period,
+// or straight away with an optional refund of the unused part of the period
 func (app *application) CancelSubscription(w http.ResponseWriter, r *http.Request) {
 
 	var subToCancel struct {
 		ID            int    `json:"id"`
 		PaymentIntent string `json:"pi"`
 		Currency      string `json:"currency"`
+		Mode          string `json:"mode"`
+		Refund        bool   `json:"refund"`
 	}
 	err := app.readJSON(w, r, &subToCancel)
 	if err != nil {
@@ -723,34 +1373,298 @@ func (app *application) CancelSubscription(w http.ResponseWriter, r *http.Reques
 		app.badRequest(w, r, err)
 		return
 	}
-	card := cards.Card{
-		Secret:   app.config.stripe.secret,
-		Key:      app.config.stripe.key,
-		Currency: subToCancel.Currency,
+
+	user, err := app.authenticateToken(r)
+	if err != nil {
+		app.invalidCredentials(w)
+		return
+	}
+
+	// the subscription id comes from the database, not the browser
+	order, err := app.getSubscriptionOrder(subToCancel.ID)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if subToCancel.Mode == "" {
+		subToCancel.Mode = "period_end"
+	}
+
+	v := validator.New()
+	v.Check(subToCancel.Mode == "period_end" || subToCancel.Mode == "now", "mode", "must be period_end or now")
+	// cleared, pending cancellation, paused, trialing or past due
+	v.Check(order.StatusID == 1 || order.StatusID == 4 || order.StatusID == 5 || order.StatusID == 6 || order.StatusID == 7, "id", "is not an active subscription")
+	v.Check(subToCancel.Mode != "period_end" || order.StatusID != 4, "id", "is already cancelling at period end")
+	v.Check(!subToCancel.Refund || subToCancel.Mode == "now", "refund", "is only possible when cancelling now")
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	if subToCancel.Mode == "period_end" {
+		err = app.gateway(r).CancelSubscription(order.Transaction.PaymentIntent)
+		if err != nil {
+			app.errorLog.Println(err)
+			app.badRequest(w, r, err)
+			return
+		}
+
+		// pending cancellation; the webhook marks it cancelled when the period ends
+		err = app.DB.UpdateOrderStatus(order.ID, 4)
+		if err != nil {
+			app.errorLog.Println(err)
+			app.badRequest(w, r, errors.New("the subscription will cancel at period end, but the database could not be updated"))
+			return
+		}
+
+		resp.Error = false
+		resp.Message = "Subscription will cancel at the end of the period"
+		app.writeJSON(w, http.StatusCreated, resp)
+		return
 	}
-	err = card.CancelSubscription(subToCancel.PaymentIntent)
+
+	subscription, err := app.gateway(r).CancelSubscriptionNow(order.Transaction.PaymentIntent)
 	if err != nil {
 		app.errorLog.Println(err)
 		app.badRequest(w, r, err)
 		return
 	}
 
+	resp.Message = "Subscription Cancelled"
+
+	invoice := subscription.LatestInvoice
+	if subToCancel.Refund && invoice != nil && invoice.PaymentIntent != nil {
+		amount := proratedRefund(int(invoice.AmountPaid), subscription.CurrentPeriodStart, subscription.CurrentPeriodEnd, time.Now().Unix())
+		if amount > order.Refundable() {
+			amount = order.Refundable()
+		}
+		if amount > 0 {
+			rf, err := app.gateway(r).Refund(invoice.PaymentIntent.ID, amount, "prorated cancellation")
+			if err != nil {
+				app.errorLog.Println(err)
+				app.badRequest(w, r, errors.New("the subscription was cancelled, but the refund failed"))
+				return
+			}
+			err = app.DB.RecordRefund(models.Refund{
+				OrderID:        order.ID,
+				Amount:         int(rf.Amount),
+				Reason:         "prorated cancellation",
+				StripeRefundID: rf.ID,
+				RefundedBy:     user.Email,
+			})
+			if err != nil {
+				app.errorLog.Println(err)
+				app.badRequest(w, r, errors.New("the subscription was cancelled and refunded, but the database could not be updated"))
+				return
+			}
+			resp.Message = fmt.Sprintf("Subscription Cancelled and %s refunded", money.New(int(rf.Amount), string(rf.Currency)))
+		}
+	}
+
 	//update status in db
-	err = app.DB.UpdateOrderStatus(subToCancel.ID, 3)
+	err = app.DB.UpdateOrderStatus(order.ID, 3)
 	if err != nil {
 		app.errorLog.Println(err)
 		app.badRequest(w, r, errors.New("the subscription was cancelled, but the database could not be updated"))
 		return
 	}
+
+	resp.Error = false
+	app.writeJSON(w, http.StatusCreated, resp)
+}
+
+// PauseSubscription stops collecting payments for a subscription
+func (app *application) PauseSubscription(w http.ResponseWriter, r *http.Request) {
+	var subToPause struct {
+		ID int `json:"id"`
+	}
+	err := app.readJSON(w, r, &subToPause)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	order, err := app.getSubscriptionOrder(subToPause.ID)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	// order cleared
+	v.Check(order.StatusID == 1, "id", "is not an active subscription")
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	err = app.gateway(r).PauseSubscription(order.Transaction.PaymentIntent)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	// paused
+	err = app.DB.UpdateOrderStatus(order.ID, 5)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, errors.New("the subscription was paused, but the database could not be updated"))
+		return
+	}
+
 	var resp struct {
 		Error   bool   `json:"error"`
 		Message string `json:"message"`
 	}
 	resp.Error = false
-	resp.Message = "Subscription Cancelled"
+	resp.Message = "Subscription Paused"
+
+	app.writeJSON(w, http.StatusCreated, resp)
+}
+
+// ResumeSubscription undoes a pause or a pending cancellation
+func (app *application) ResumeSubscription(w http.ResponseWriter, r *http.Request) {
+	var subToResume struct {
+		ID int `json:"id"`
+	}
+	err := app.readJSON(w, r, &subToResume)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	order, err := app.getSubscriptionOrder(subToResume.ID)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	// pending cancellation or paused
+	v.Check(order.StatusID == 4 || order.StatusID == 5, "id", "is not paused or pending cancellation")
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	err = app.gateway(r).ResumeSubscription(order.Transaction.PaymentIntent)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	// cleared
+	err = app.DB.UpdateOrderStatus(order.ID, 1)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, errors.New("the subscription was resumed, but the database could not be updated"))
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	resp.Error = false
+	resp.Message = "Subscription Resumed"
+
+	app.writeJSON(w, http.StatusCreated, resp)
+}
+
+// ChangePlan upgrades or downgrades a subscription to another plan
+func (app *application) ChangePlan(w http.ResponseWriter, r *http.Request) {
+	var planChange struct {
+		ID        int    `json:"id"`
+		WidgetID  int    `json:"widget_id"`
+		Proration string `json:"proration"`
+	}
+
+	err := app.readJSON(w, r, &planChange)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	proration := stripe.SubscriptionProrationBehavior(planChange.Proration)
+	if proration == "" {
+		proration = stripe.SubscriptionProrationBehaviorCreateProrations
+	}
+
+	// the subscription id and plans come from the database, not the browser
+	order, err := app.DB.GetOrderById(planChange.ID)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+	current, err := app.DB.GetWidget(order.WidgetID)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+	plan, err := app.DB.GetWidget(planChange.WidgetID)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, errors.New("no such plan"))
+		return
+	}
+
+	v := validator.New()
+	v.Check(current.IsRecurring, "id", "is not a subscription")
+	// order cleared
+	v.Check(order.StatusID == 1, "id", "is not an active subscription")
+	v.Check(plan.IsRecurring && plan.IsActive, "widget_id", "is not a plan on sale")
+	v.Check(plan.ID != current.ID, "widget_id", "is already the subscribed plan")
+	v.Check(proration == stripe.SubscriptionProrationBehaviorCreateProrations ||
+		proration == stripe.SubscriptionProrationBehaviorAlwaysInvoice ||
+		proration == stripe.SubscriptionProrationBehaviorNone,
+		"proration", "must be create_prorations, always_invoice or none")
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	subscription, err := app.gateway(r).ChangePlan(order.Transaction.PaymentIntent, plan.PlanID, proration)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	// the new price comes from stripe, in the subscription's own currency
+	amount, _ := subscriptionAmount(subscription, plan)
+	err = app.DB.ChangeSubscriptionPlan(order.ID, plan, amount)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, errors.New("the plan was changed, but the database could not be updated"))
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	resp.Error = false
+	resp.Message = fmt.Sprintf("Subscription changed to %s", plan.Name)
 
 	app.writeJSON(w, http.StatusCreated, resp)
 }
+
 func (app *application) AllUsers(w http.ResponseWriter, r *http.Request) {
 	allUsers, err := app.DB.GetAllUsers()
 
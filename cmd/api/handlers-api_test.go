@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"myapp/internal/urlsigner"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stripe/stripe-go/v72"
+)
+
+const testToken = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// expectAdmin expects authenticateToken to find the admin for testToken
+func expectAdmin(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT u.id,u.first_name, u.last_name, u.email FROM users u")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "first_name", "last_name", "email"}).
+			AddRow(1, "Admin", "User", "admin@example.com"))
+}
+
+// expectOrder expects GetOrderById to load order 1, paid for amount by pi,
+// of which refunded has already been refunded
+func expectOrder(mock sqlmock.Sqlmock, pi string, amount, refunded int) {
+	now := time.Now()
+
+	mock.ExpectQuery(regexp.QuoteMeta("from orders o")).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"o.id", "o.widget_id", "o.transaction_id", "o.customer_id", "o.status_id",
+			"o.quantity", "o.amount", "o.discount", "o.tax", "o.tax_state", "o.created_at", "o.updated_at", "w.id", "w.name",
+			"t.id", "t.amount", "t.currency", "t.last_four", "t.expiry_month", "t.expiry_year", "t.payment_intent",
+			"t.bank_return_code", "c.id", "c.first_name", "c.last_name", "c.email"}).
+			AddRow(1, 2, 3, 4, 1, 1, amount, 0, 0, "", now, now, 2, "Widget",
+				3, amount, "inr", "4242", 12, 2030, pi, "ch_1", 4, "Jane", "Doe", "jane@example.com"))
+	mock.ExpectQuery(regexp.QuoteMeta("FROM order_items i")).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"i.id", "i.order_id", "i.widget_id", "i.quantity", "i.price",
+			"i.created_at", "i.updated_at", "w.id", "w.name"}).
+			AddRow(1, 1, 2, 1, amount, now, now, 2, "Widget"))
+	mock.ExpectQuery(regexp.QuoteMeta("FROM order_taxes")).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "rate", "amount"}))
+
+	refunds := sqlmock.NewRows([]string{"id", "order_id", "amount", "reason", "stripe_refund_id", "refunded_by", "created_at", "updated_at"})
+	if refunded > 0 {
+		refunds.AddRow(1, 1, refunded, "", "re_old", "stripe", now, now)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta("FROM refunds")).
+		WithArgs(1).
+		WillReturnRows(refunds)
+}
+
+func refundRequest(amount int) *http.Request {
+	body := strings.NewReader(fmt.Sprintf(`{"id": 1, "amount": %d, "reason": "requested_by_customer"}`, amount))
+	req := httptest.NewRequest(http.MethodPost, "/api/admin/refund", body)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	return req
+}
+
+func TestRefundChargePartial(t *testing.T) {
+	app, mock, gateway := newTestApp(t)
+
+	pi, _, err := gateway.CreatePaymentIntent("inr", 5000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gateway.Confirm(pi.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	expectAdmin(mock)
+	expectOrder(mock, pi.ID, 5000, 1000)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT IGNORE INTO refunds")).
+		WithArgs(1, 2000, "requested_by_customer", sqlmock.AnyArg(), "admin@example.com", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT t.id, t.amount, COALESCE(SUM(r.amount), 0)")).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "amount", "refunded"}).AddRow(3, 5000, 3000))
+	// partially refunded
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE transactions SET transaction_status_id = ?")).
+		WithArgs(5, sqlmock.AnyArg(), 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+	app.RefundCharge(rr, refundRequest(2000))
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d: %s", rr.Code, http.StatusCreated, rr.Body.String())
+	}
+	if _, msg := decodeResponse(t, rr); msg != "Charge Partially Refunded" {
+		t.Errorf("message = %q, want %q", msg, "Charge Partially Refunded")
+	}
+	if len(gateway.Refunds) != 1 || gateway.Refunds[0].Amount != 2000 {
+		t.Errorf("stripe refunds = %v, want one of 2000", gateway.Refunds)
+	}
+}
+
+func TestRefundChargeMoreThanBalance(t *testing.T) {
+	app, mock, gateway := newTestApp(t)
+
+	pi, _, err := gateway.CreatePaymentIntent("inr", 5000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gateway.Confirm(pi.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	expectAdmin(mock)
+	expectOrder(mock, pi.ID, 5000, 1000)
+
+	rr := httptest.NewRecorder()
+	app.RefundCharge(rr, refundRequest(4500))
+
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusUnprocessableEntity)
+	}
+	if len(gateway.Refunds) != 0 {
+		t.Errorf("stripe refunded %v for an amount over the balance", gateway.Refunds)
+	}
+}
+
+func TestRefundChargeWithoutToken(t *testing.T) {
+	app, _, gateway := newTestApp(t)
+
+	req := refundRequest(1000)
+	req.Header.Del("Authorization")
+
+	rr := httptest.NewRecorder()
+	app.RefundCharge(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusUnauthorized)
+	}
+	if len(gateway.Refunds) != 0 {
+		t.Errorf("stripe refunded %v without a token", gateway.Refunds)
+	}
+}
+
+func TestProratedRefund(t *testing.T) {
+	tests := []struct {
+		name  string
+		now   int64
+		start int64
+		end   int64
+		want  int
+	}{
+		{"start of period", 100, 100, 200, 3000},
+		{"half way", 150, 100, 200, 1500},
+		{"end of period", 200, 100, 200, 0},
+		{"after the period", 250, 100, 200, 0},
+		{"before the period", 50, 100, 200, 3000},
+		{"empty period", 100, 100, 100, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := proratedRefund(3000, tt.start, tt.end, tt.now); got != tt.want {
+				t.Errorf("proratedRefund() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVirtualTerminalPaymentSucceeded(t *testing.T) {
+	tests := []struct {
+		name     string
+		decline  bool
+		confirm  bool
+		recorded bool
+	}{
+		{"not confirmed", false, false, false},
+		{"declined", true, true, false},
+		{"confirmed", false, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, mock, gateway := newTestApp(t)
+
+			gateway.AddCard("pm_1", stripe.PaymentMethodCardBrandVisa, "4242", 12, 2030)
+			pi, _, err := gateway.AuthorizePaymentIntent("inr", 5000, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.decline {
+				gateway.Decline(stripe.ErrorCodeCardDeclined)
+			}
+			if tt.confirm {
+				// the customer's browser confirms the card with stripe.js
+				if err := gateway.Confirm(pi.ID); (err != nil) != tt.decline {
+					t.Fatalf("Confirm() error = %v", err)
+				}
+			}
+
+			if tt.recorded {
+				// an authorization is recorded as a hold with nothing captured yet
+				mock.ExpectExec(regexp.QuoteMeta("INSERT INTO transactions")).
+					WithArgs(0, "inr", "4242", sqlmock.AnyArg(), 6, 12, 2030, pi.ID, "pm_1", "", false, 5000,
+						sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(9, 1))
+			}
+
+			body := strings.NewReader(fmt.Sprintf(`{"payment_intent": %q, "payment_method": "pm_1"}`, pi.ID))
+			rr := httptest.NewRecorder()
+			app.VirtualTerminalPaymentSucceeded(rr, httptest.NewRequest(http.MethodPost, "/api/admin/virtual-terminal-succeeded", body))
+
+			// badRequest answers 200 with the error flag set
+			if failed := strings.Contains(rr.Body.String(), `"error": true`); failed == tt.recorded {
+				t.Errorf("recorded = %v, want %v: %s", !failed, tt.recorded, rr.Body.String())
+			}
+		})
+	}
+}
+
+// expectReservation expects GetPaymentIntent to load widget 2 and reserve
+// quantity of it
+func expectReservation(mock sqlmock.Sqlmock, quantity int) {
+	now := time.Now()
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM widgets where id=?")).
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "inventory_level", "price", "image",
+			"is_recurring", "plan_id", "is_active", "trial_days", "created_at", "updated_at"}).
+			AddRow(2, "Widget", "", 10, 5000, "", false, "", true, 0, now, now))
+	mock.ExpectQuery(regexp.QuoteMeta("FROM widget_prices")).
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"currency", "price"}))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT w.inventory_level")).
+		WillReturnRows(sqlmock.NewRows([]string{"available"}).AddRow(10))
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT name FROM widgets WHERE id = ? FOR UPDATE")).
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("Widget"))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT w.inventory_level")).
+		WillReturnRows(sqlmock.NewRows([]string{"available"}).AddRow(10))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO stock_reservations")).
+		WithArgs(sqlmock.AnyArg(), 2, quantity, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+}
+
+func TestGetPaymentIntentSaveCardAnonymous(t *testing.T) {
+	app, mock, gateway := newTestApp(t)
+
+	// a customer who saved a card before
+	existing, _, err := gateway.CreateCustomer("", "jane@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectReservation(mock, 1)
+
+	// someone who is not signed in types the same email
+	body := strings.NewReader(`{"product_id": "2", "quantity": 1, "save_card": true, "email": "jane@example.com"}`)
+	rr := httptest.NewRecorder()
+	app.GetPaymentIntent(rr, httptest.NewRequest(http.MethodPost, "/api/payment-intent", body))
+
+	var pi stripe.PaymentIntent
+	if err := json.Unmarshal(rr.Body.Bytes(), &pi); err != nil || pi.ID == "" {
+		t.Fatalf("no payment intent: %s", rr.Body.String())
+	}
+	if pi.Customer == nil || pi.Customer.ID == existing.ID {
+		t.Errorf("card saved to customer %v, want a new customer", pi.Customer)
+	}
+	if len(gateway.Customers) != 2 {
+		t.Errorf("stripe has %d customers, want 2", len(gateway.Customers))
+	}
+	if existing.InvoiceSettings.DefaultPaymentMethod != nil {
+		t.Errorf("existing customer's default card changed to %v", existing.InvoiceSettings.DefaultPaymentMethod)
+	}
+}
+
+// expectPlan expects ConfirmSubscription to load widget 3, the subscription
+// to plan_1
+func expectPlan(mock sqlmock.Sqlmock, active bool) {
+	now := time.Now()
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM widgets where id=?")).
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "inventory_level", "price", "image",
+			"is_recurring", "plan_id", "is_active", "trial_days", "created_at", "updated_at"}).
+			AddRow(3, "Plan", "", 0, 3000, "", true, "plan_1", active, 0, now, now))
+	mock.ExpectQuery(regexp.QuoteMeta("FROM widget_prices")).
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"currency", "price"}))
+}
+
+func TestConfirmSubscriptionRejected(t *testing.T) {
+	tests := []struct {
+		name     string
+		active   bool
+		email    string
+		signedIn bool
+		message  string
+	}{
+		{"inactive plan", false, "jane@example.com", false, "Invalid plan"},
+		{"another email", true, "mallory@example.com", false, "Invalid subscription"},
+		{"another signed in customer", true, "mallory@example.com", true, "Invalid subscription"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, mock, gateway := newTestApp(t)
+			app.config.secretKey = "secret"
+			app.config.frontEnd = "http://localhost:4000"
+
+			// jane subscribed, and had to authenticate with her bank
+			gateway.AddCard("pm_1", stripe.PaymentMethodCardBrandVisa, "4242", 12, 2030)
+			jane, _, err := gateway.CreateCustomer("pm_1", "jane@example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			subscription, err := gateway.SubscribeToPlan(jane, "plan_1", "jane@example.com", "4242", "visa", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			token := ""
+			if tt.signedIn {
+				signer := urlsigner.Signer{Secret: []byte(app.config.secretKey)}
+				token = signer.GenerateTokenFromString(app.config.frontEnd + "/customer?email=" + tt.email)
+			}
+
+			expectPlan(mock, tt.active)
+			if tt.active {
+				mock.ExpectQuery(regexp.QuoteMeta("SELECT o.id FROM orders o")).
+					WithArgs(subscription.ID).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}))
+			}
+			if tt.signedIn {
+				mock.ExpectQuery(regexp.QuoteMeta("FROM customers")).
+					WithArgs(tt.email).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "first_name", "last_name", "email", "stripe_customer_id",
+						"created_at", "updated_at"}).
+						AddRow(5, "Mallory", "Smith", tt.email, "cus_mallory", time.Now(), time.Now()))
+			}
+
+			body := strings.NewReader(fmt.Sprintf(`{"product_id": "3", "first_name": "Mallory", "last_name": "Smith",
+				"email": %q, "subscription_id": %q, "customer_token": %q}`, tt.email, subscription.ID, token))
+			rr := httptest.NewRecorder()
+			app.ConfirmSubscription(rr, httptest.NewRequest(http.MethodPost, "/api/confirm-subscription", body))
+
+			var resp jsonResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("response %q is not json: %v", rr.Body.String(), err)
+			}
+			if resp.OK || resp.Message != tt.message {
+				t.Errorf("response = %+v, want %q", resp, tt.message)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"myapp/internal/cards"
+	"myapp/internal/models"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// newTestApp returns an application backed by a mock database and a fake
+// payment gateway. The mock's expectations are checked when the test ends.
+func newTestApp(t *testing.T) (*application, sqlmock.Sqlmock, *cards.FakeGateway) {
+	t.Helper()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+	})
+
+	gateway := cards.NewFakeGateway()
+	app := &application{
+		infoLog:  log.New(io.Discard, "", 0),
+		errorLog: log.New(io.Discard, "", 0),
+		DB:       models.DBModel{DB: db},
+		Gateway:  gateway,
+	}
+	app.config.stripe.webhookSecret = "whsec_test"
+	return app, mock, gateway
+}
+
+// decodeResponse reads the error and message of a JSON response
+func decodeResponse(t *testing.T, rr *httptest.ResponseRecorder) (bool, string) {
+	t.Helper()
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("response %q is not json: %v", rr.Body.String(), err)
+	}
+	return resp.Error, resp.Message
+}
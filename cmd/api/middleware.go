@@ -1,6 +1,23 @@
 package main
 
-import "net/http"
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"myapp/internal/cards"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type contextKey string
+
+const idempotencyKeyCtx = contextKey("idempotency_key")
 
 func (app *application) Auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -12,3 +29,174 @@ func (app *application) Auth(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// rateWindow counts the requests a client made since start
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// RateLimit allows each client address limit requests per window and answers
+// the rest with 429 Too Many Requests
+func (app *application) RateLimit(limit int, window time.Duration) func(http.Handler) http.Handler {
+	var mu sync.Mutex
+	clients := make(map[string]*rateWindow)
+	lastSweep := time.Now()
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				ip = r.RemoteAddr
+			}
+
+			now := time.Now()
+			mu.Lock()
+			// forget clients whose window is over, so the map does not grow
+			if now.Sub(lastSweep) > window {
+				for addr, c := range clients {
+					if now.Sub(c.start) > window {
+						delete(clients, addr)
+					}
+				}
+				lastSweep = now
+			}
+			c, ok := clients[ip]
+			if !ok || now.Sub(c.start) > window {
+				c = &rateWindow{start: now}
+				clients[ip] = c
+			}
+			c.count++
+			allowed := c.count <= limit
+			mu.Unlock()
+
+			if !allowed {
+				var resp struct {
+					Error   bool   `json:"error"`
+					Message string `json:"message"`
+				}
+				resp.Error = true
+				resp.Message = "too many requests, please try again later"
+				w.Header().Set("Retry-After", fmt.Sprintf("%d", int(window.Seconds())))
+				app.writeJSON(w, http.StatusTooManyRequests, resp)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// responseRecorder passes a response through while keeping a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	status  int
+	written bool
+	body    bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.written = true
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.written = true
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// Idempotent honours the Idempotency-Key header: the first response for a key
+// is stored and replayed for every retry, so a retried POST is not repeated.
+// Reusing a key for a different request body is refused.
+func (app *application) Idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > 255 {
+			app.badRequest(w, r, errors.New("Idempotency-Key must be at most 255 characters"))
+			return
+		}
+
+		// the body is hashed so a key can not be replayed for another request;
+		// readJSON refuses bodies over 1MB, so there is no point reading more
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1048577))
+		if err != nil {
+			app.errorLog.Println(err)
+			app.badRequest(w, r, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		hash := hex.EncodeToString(sum[:])
+
+		reserved, err := app.DB.ReserveIdempotencyKey(key, r.URL.Path, hash)
+		if err != nil {
+			app.errorLog.Println(err)
+			app.badRequest(w, r, err)
+			return
+		}
+
+		if !reserved {
+			stored, err := app.DB.GetIdempotentResponse(key)
+			if err != nil {
+				app.errorLog.Println(err)
+				app.badRequest(w, r, err)
+				return
+			}
+
+			var resp struct {
+				Error   bool   `json:"error"`
+				Message string `json:"message"`
+			}
+			resp.Error = true
+
+			switch {
+			case stored.Path != r.URL.Path, stored.Hash != hash:
+				resp.Message = "Idempotency-Key was already used for a different request"
+				app.writeJSON(w, http.StatusUnprocessableEntity, resp)
+			case stored.Status == 0:
+				resp.Message = "a request with this Idempotency-Key is still in progress"
+				app.writeJSON(w, http.StatusConflict, resp)
+			default:
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(stored.Status)
+				w.Write(stored.Body)
+			}
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		ctx := context.WithValue(r.Context(), idempotencyKeyCtx, key)
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		// server errors are not stored, so the client can retry them, and
+		// neither is a handler that wrote nothing, which would replay as an
+		// empty 200
+		if rec.status >= http.StatusInternalServerError || !rec.written {
+			if !rec.written {
+				app.errorLog.Printf("%s wrote no response for Idempotency-Key %s", r.URL.Path, key)
+			}
+			err = app.DB.DeleteIdempotencyKey(key)
+		} else {
+			err = app.DB.SaveIdempotentResponse(key, rec.status, rec.body.Bytes())
+		}
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+	})
+}
+
+// gateway returns the payment gateway for a request, carrying the request's
+// Idempotency-Key through to stripe when there is one
+func (app *application) gateway(r *http.Request) cards.PaymentGateway {
+	key, ok := r.Context().Value(idempotencyKeyCtx).(string)
+	if !ok || key == "" {
+		return app.Gateway
+	}
+	return app.Gateway.WithIdempotencyKey(key)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const testKey = "key-1"
+
+func idempotentRequest(body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/api/admin/refund", strings.NewReader(body))
+	req.Header.Set("Idempotency-Key", testKey)
+	return req
+}
+
+func bodyHash(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// expectReserve expects ReserveIdempotencyKey to claim testKey, or to find
+// it already used when reserved is false
+func expectReserve(mock sqlmock.Sqlmock, body string, reserved bool) {
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM idempotency_keys WHERE idempotency_key = ?")).
+		WithArgs(testKey, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	rows := int64(0)
+	if reserved {
+		rows = 1
+	}
+	mock.ExpectExec(regexp.QuoteMeta("INSERT IGNORE INTO idempotency_keys")).
+		WithArgs(testKey, "/api/admin/refund", bodyHash(body), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, rows))
+}
+
+// expectStored expects GetIdempotentResponse to find the response stored for testKey
+func expectStored(mock sqlmock.Sqlmock, hash string, status int, body string) {
+	mock.ExpectQuery(regexp.QuoteMeta("FROM idempotency_keys WHERE idempotency_key = ?")).
+		WithArgs(testKey).
+		WillReturnRows(sqlmock.NewRows([]string{"idempotency_key", "request_path", "request_hash", "response_status",
+			"response_body", "created_at", "updated_at"}).
+			AddRow(testKey, "/api/admin/refund", hash, status, []byte(body), time.Now(), time.Now()))
+}
+
+func TestIdempotentStoresFirstResponse(t *testing.T) {
+	app, mock, gateway := newTestApp(t)
+
+	body := `{"id": 1}`
+	expectReserve(mock, body, true)
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE idempotency_keys SET response_status = ?")).
+		WithArgs(http.StatusCreated, []byte(`{"ok":true}`), sqlmock.AnyArg(), testKey).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	handler := app.Idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the handler still sees the body, and stripe gets the key
+		if err := app.readJSON(w, r, &struct{ ID int }{}); err != nil {
+			t.Errorf("readJSON: %v", err)
+		}
+		app.gateway(r).RetrievePaymentIntent("pi_missing")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"ok":true}`))
+	}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, idempotentRequest(body))
+
+	if rr.Code != http.StatusCreated {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusCreated)
+	}
+	if len(gateway.IdempotencyKeys) != 1 || gateway.IdempotencyKeys[0] != testKey {
+		t.Errorf("stripe idempotency keys = %v, want [%s]", gateway.IdempotencyKeys, testKey)
+	}
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	tests := []struct {
+		name       string
+		hash       string
+		status     int
+		wantStatus int
+		replayed   bool
+	}{
+		{"same request", bodyHash(`{"id": 1}`), http.StatusCreated, http.StatusCreated, true},
+		{"different body", bodyHash(`{"id": 2}`), http.StatusCreated, http.StatusUnprocessableEntity, false},
+		{"still in progress", bodyHash(`{"id": 1}`), 0, http.StatusConflict, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, mock, _ := newTestApp(t)
+
+			body := `{"id": 1}`
+			expectReserve(mock, body, false)
+			expectStored(mock, tt.hash, tt.status, `{"ok":true}`)
+
+			handler := app.Idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				t.Error("the handler ran for a key that was already used")
+			}))
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, idempotentRequest(body))
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rr.Code, tt.wantStatus)
+			}
+			if replayed := rr.Header().Get("Idempotent-Replayed") == "true"; replayed != tt.replayed {
+				t.Errorf("replayed = %v, want %v", replayed, tt.replayed)
+			}
+			if tt.replayed && rr.Body.String() != `{"ok":true}` {
+				t.Errorf("body = %q, want the stored response", rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestIdempotentForgetsEmptyResponse(t *testing.T) {
+	app, mock, _ := newTestApp(t)
+
+	body := `{"id": 1}`
+	expectReserve(mock, body, true)
+	// nothing is stored, so a retry runs the handler again
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM idempotency_keys WHERE idempotency_key = ?")).
+		WithArgs(testKey).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	handler := app.Idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, idempotentRequest(body))
+}
+
+func TestIdempotentForgetsServerError(t *testing.T) {
+	app, mock, _ := newTestApp(t)
+
+	body := `{"id": 1}`
+	expectReserve(mock, body, true)
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM idempotency_keys WHERE idempotency_key = ?")).
+		WithArgs(testKey).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	handler := app.Idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, idempotentRequest(body))
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	app, _, _ := newTestApp(t)
+
+	handler := app.RateLimit(2, time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		addr       string
+		wantStatus int
+	}{
+		{"192.0.2.1:1000", http.StatusOK},
+		{"192.0.2.1:1001", http.StatusOK},
+		{"192.0.2.1:1002", http.StatusTooManyRequests},
+		// another client has its own allowance
+		{"192.0.2.2:1000", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/api/payment-intent", nil)
+		req.RemoteAddr = tt.addr
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.addr, rr.Code, tt.wantStatus)
+		}
+		if tt.wantStatus == http.StatusTooManyRequests && rr.Header().Get("Retry-After") != "60" {
+			t.Errorf("%s: Retry-After = %q, want %q", tt.addr, rr.Header().Get("Retry-After"), "60")
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// cancelExpiredReservations cancels the payment intents whose stock
+// reservations have expired, so a customer can not pay for stock that may
+// since have been sold to someone else
+func (app *application) cancelExpiredReservations() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		expired, err := app.DB.GetExpiredReservations(time.Now())
+		if err != nil {
+			app.errorLog.Println(err)
+			continue
+		}
+
+		for _, id := range expired {
+			pi, err := app.Gateway.RetrievePaymentIntent(id)
+			if err != nil {
+				// tried again on the next tick
+				app.errorLog.Println(err)
+				continue
+			}
+
+			// a paid intent takes its stock when the order is saved, which
+			// refuses the order if the stock has gone
+			if pi.Status != stripe.PaymentIntentStatusSucceeded && pi.Status != stripe.PaymentIntentStatusCanceled {
+				err = app.Gateway.CancelPaymentIntent(id)
+				if err != nil {
+					app.errorLog.Println(err)
+					continue
+				}
+			}
+
+			err = app.DB.ReleaseStock(id)
+			if err != nil {
+				app.errorLog.Println(err)
+			}
+		}
+	}
+}
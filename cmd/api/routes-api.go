@@ -2,6 +2,7 @@ package main
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/cors"
@@ -13,34 +14,62 @@ func (app *application) routes() http.Handler {
 	mux.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"https://*", "http://*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "Idempotency-Key"},
 		AllowCredentials: false,
 		MaxAge:           300,
 	}))
 
-	mux.Post("/api/payment-intent", app.GetPaymentIntent)
+	// every payment intent holds stock for a while, so one client can not be
+	// allowed to reserve it all
+	mux.With(app.RateLimit(10, time.Minute), app.Idempotent).Post("/api/payment-intent", app.GetPaymentIntent)
 	mux.Get("/api/widget/{id}", app.GetWidgetByID)
 
-	mux.Post("/api/create-customer-and-subscribe-to-plan", app.CreateCustomerAndSubscribeToPlan)
+	mux.With(app.Idempotent).Post("/api/create-customer-and-subscribe-to-plan", app.CreateCustomerAndSubscribeToPlan)
+	mux.With(app.Idempotent).Post("/api/confirm-subscription", app.ConfirmSubscription)
 	mux.Post("/api/authenticate", app.CreateAuthToken)
 	mux.Post("/api/is-authenticated", app.CheckAuthentication)
 	mux.Post("/api/forgot-password", app.SendPasswordResetEmail)
 	mux.Post("/api/reset-password", app.ResetPassword)
+	mux.Post("/api/customer-login-link", app.SendCustomerLoginLink)
+	// codes can not be guessed by trying them one after another
+	mux.With(app.RateLimit(20, time.Minute)).Post("/api/coupon", app.CheckCoupon)
+	mux.With(app.Idempotent).Post("/api/subscription-card", app.UpdateSubscriptionCard)
+
+	mux.Post("/api/webhooks/stripe", app.StripeWebhook)
 
 	mux.Route("/api/admin", func(mux chi.Router) {
 		mux.Use(app.Auth)
 
+		mux.Post("/virtual-terminal-payment-intent", app.VirtualTerminalPaymentIntent)
 		mux.Post("/virtual-terminal-succeeded", app.VirtualTerminalPaymentSucceeded)
+		mux.Post("/terminal-sales", app.TerminalSales)
+		mux.Post("/terminal-sales/{id}", app.GetTerminalSale)
+		mux.With(app.Idempotent).Post("/capture", app.CaptureCharge)
+		mux.With(app.Idempotent).Post("/void", app.VoidCharge)
 		mux.Post("/all-sales", app.AllSales)
 		mux.Post("/all-subscriptions", app.AllSubscriptions)
+		mux.Post("/revenue", app.Revenue)
 		mux.Post("/get-sale/{id}", app.GetSale)
-		mux.Post("/refund", app.RefundCharge)
-		mux.Post("/cancel-subscription", app.CancelSubscription)
+		mux.With(app.Idempotent).Post("/refund", app.RefundCharge)
+		mux.With(app.Idempotent).Post("/cancel-subscription", app.CancelSubscription)
+		mux.With(app.Idempotent).Post("/pause-subscription", app.PauseSubscription)
+		mux.With(app.Idempotent).Post("/resume-subscription", app.ResumeSubscription)
+		mux.With(app.Idempotent).Post("/change-plan", app.ChangePlan)
 		mux.Post("/all-users", app.AllUsers)
 		mux.Post("/all-users/{id}", app.OneUSer)
 		mux.Post("/all-users/edit/{id}", app.EditUSer)
 		mux.Post("/all-users/delete/{id}", app.DeleteUSer)
 
+		mux.Post("/widgets", app.AllWidgets)
+		mux.Post("/widgets/{id}", app.OneWidget)
+		mux.Post("/widgets/edit/{id}", app.EditWidget)
+		mux.Post("/widgets/retire/{id}", app.RetireWidget)
+		mux.Post("/widgets/upload-image", app.UploadWidgetImage)
+
+		mux.Post("/coupons", app.AllCoupons)
+		mux.Post("/coupons/{id}", app.OneCoupon)
+		mux.Post("/coupons/edit/{id}", app.EditCoupon)
+
 	})
 
 	return mux
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"myapp/internal/models"
+	"myapp/internal/money"
+	"myapp/internal/validator"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// TerminalSales returns the payments taken in the virtual terminal
+func (app *application) TerminalSales(w http.ResponseWriter, r *http.Request) {
+	sales, err := app.DB.GetTerminalSales()
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+	app.writeJSON(w, http.StatusOK, sales)
+}
+
+// GetTerminalSale returns one virtual terminal payment
+func (app *application) GetTerminalSale(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	txnID, err := strconv.Atoi(id)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	txn, err := app.DB.GetTransaction(txnID)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		models.Transaction
+		CanCapture bool `json:"can_capture"`
+	}
+	resp.Transaction = txn
+	resp.CanCapture = txn.CanCapture(time.Now())
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// CaptureCharge takes the full or a partial amount of an authorization; the
+// rest of the hold is released
+func (app *application) CaptureCharge(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		ID     int `json:"id"`
+		Amount int `json:"amount"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	// the payment intent and the hold come from the database, not the browser
+	txn, err := app.DB.GetTransaction(payload.ID)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+	if !txn.CanCapture(time.Now()) {
+		app.badRequest(w, r, errors.New("this payment is not an authorization that can still be captured"))
+		return
+	}
+
+	v := validator.New()
+	v.Check(payload.Amount > 0, "amount", "must be greater than zero")
+	v.Check(payload.Amount <= txn.AuthorizedAmount, "amount", fmt.Sprintf("must not be more than the authorized %s", money.New(txn.AuthorizedAmount, txn.Currency)))
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	pi, err := app.gateway(r).CapturePaymentIntent(txn.PaymentIntent, payload.Amount)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.CaptureTransaction(txn.ID, int(pi.AmountReceived))
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, errors.New("the payment was captured, but the database could not be updated"))
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	resp.Error = false
+	resp.Message = fmt.Sprintf("%s captured", money.New(int(pi.AmountReceived), txn.Currency))
+
+	app.writeJSON(w, http.StatusCreated, resp)
+}
+
+// VoidCharge releases the hold of an authorization without taking anything
+func (app *application) VoidCharge(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		ID int `json:"id"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	txn, err := app.DB.GetTransaction(payload.ID)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+	if !txn.CanCapture(time.Now()) {
+		app.badRequest(w, r, errors.New("this payment is not an authorization that can still be voided"))
+		return
+	}
+
+	err = app.gateway(r).CancelPaymentIntent(txn.PaymentIntent)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.VoidTransactionByPaymentIntent(txn.PaymentIntent)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, errors.New("the authorization was voided, but the database could not be updated"))
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	resp.Error = false
+	resp.Message = "Authorization voided"
+
+	app.writeJSON(w, http.StatusCreated, resp)
+}
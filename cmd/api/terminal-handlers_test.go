@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"myapp/internal/cards"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stripe/stripe-go/v72"
+)
+
+// expectAuthorization expects GetTransaction to load an authorization of
+// amount held by pi
+func expectAuthorization(mock sqlmock.Sqlmock, id int, pi string, amount int, captureBefore time.Time) {
+	rows := sqlmock.NewRows([]string{"id", "amount", "currency", "last_four", "expiry_month", "expiry_year",
+		"payment_intent", "payment_method", "bank_return_code", "transaction_status_id",
+		"card_brand", "card_saved", "authorized_amount", "capture_before", "created_at", "updated_at"}).
+		AddRow(id, 0, "inr", "4242", 12, 2030, pi, "pm_1", "ch_1", 6, "visa", false, amount, captureBefore, time.Now(), time.Now())
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM transactions t WHERE t.id = ?")).
+		WithArgs(id).
+		WillReturnRows(rows)
+}
+
+// authorize places a hold of amount on a card, as the virtual terminal does
+func authorize(t *testing.T, gateway *cards.FakeGateway, amount int) *stripe.PaymentIntent {
+	t.Helper()
+
+	pi, _, err := gateway.AuthorizePaymentIntent("inr", amount, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gateway.Confirm(pi.ID); err != nil {
+		t.Fatal(err)
+	}
+	return pi
+}
+
+func TestCaptureCharge(t *testing.T) {
+	tests := []struct {
+		name       string
+		amount     int
+		wantStatus int
+		captured   int64
+	}{
+		{"full", 5000, http.StatusCreated, 5000},
+		{"partial", 3000, http.StatusCreated, 3000},
+		{"more than the hold", 6000, http.StatusUnprocessableEntity, 0},
+		{"nothing", 0, http.StatusUnprocessableEntity, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, mock, gateway := newTestApp(t)
+
+			pi := authorize(t, gateway, 5000)
+
+			expectAuthorization(mock, 7, pi.ID, 5000, time.Now().Add(24*time.Hour))
+			if tt.captured > 0 {
+				mock.ExpectExec(regexp.QuoteMeta("UPDATE transactions SET amount = ?, transaction_status_id = 2")).
+					WithArgs(int(tt.captured), sqlmock.AnyArg(), 7).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			body := strings.NewReader(fmt.Sprintf(`{"id": 7, "amount": %d}`, tt.amount))
+			rr := httptest.NewRecorder()
+			app.CaptureCharge(rr, httptest.NewRequest(http.MethodPost, "/api/admin/capture", body))
+
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rr.Code, tt.wantStatus, rr.Body.String())
+			}
+			if pi.AmountReceived != tt.captured {
+				t.Errorf("stripe captured %d, want %d", pi.AmountReceived, tt.captured)
+			}
+		})
+	}
+}
+
+func TestCaptureChargeExpiredHold(t *testing.T) {
+	app, mock, gateway := newTestApp(t)
+
+	pi := authorize(t, gateway, 5000)
+	expectAuthorization(mock, 7, pi.ID, 5000, time.Now().Add(-time.Hour))
+
+	rr := httptest.NewRecorder()
+	app.CaptureCharge(rr, httptest.NewRequest(http.MethodPost, "/api/admin/capture", strings.NewReader(`{"id": 7, "amount": 5000}`)))
+
+	// badRequest answers 200 with the error flag set
+	if failed, _ := decodeResponse(t, rr); !failed {
+		t.Errorf("an expired hold was captured: %s", rr.Body.String())
+	}
+	if pi.Status != stripe.PaymentIntentStatusRequiresCapture {
+		t.Errorf("payment intent is %s, want it left alone", pi.Status)
+	}
+}
+
+func TestVoidCharge(t *testing.T) {
+	app, mock, gateway := newTestApp(t)
+
+	pi := authorize(t, gateway, 5000)
+
+	expectAuthorization(mock, 7, pi.ID, 5000, time.Now().Add(24*time.Hour))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE transactions SET transaction_status_id = 7")).
+		WithArgs(sqlmock.AnyArg(), pi.ID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	rr := httptest.NewRecorder()
+	app.VoidCharge(rr, httptest.NewRequest(http.MethodPost, "/api/admin/void", strings.NewReader(`{"id": 7}`)))
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d: %s", rr.Code, http.StatusCreated, rr.Body.String())
+	}
+	if pi.Status != stripe.PaymentIntentStatusCanceled {
+		t.Errorf("payment intent is %s, want %s", pi.Status, stripe.PaymentIntentStatusCanceled)
+	}
+}
+
+func TestVirtualTerminalPaymentIntentCurrency(t *testing.T) {
+	tests := []struct {
+		name          string
+		currency      string
+		manualCapture bool
+		want          string
+	}{
+		{"none", "", false, "inr"},
+		{"upper case", "USD", false, "usd"},
+		{"hold with none", "", true, "inr"},
+		{"hold in mixed case", "Usd", true, "usd"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, _, _ := newTestApp(t)
+
+			body := strings.NewReader(fmt.Sprintf(`{"amount": "5000", "currency": %q, "manual_capture": %t}`, tt.currency, tt.manualCapture))
+			rr := httptest.NewRecorder()
+			app.VirtualTerminalPaymentIntent(rr, httptest.NewRequest(http.MethodPost, "/api/admin/virtual-terminal-payment-intent", body))
+
+			var pi stripe.PaymentIntent
+			if err := json.Unmarshal(rr.Body.Bytes(), &pi); err != nil || pi.ID == "" {
+				t.Fatalf("no payment intent: %s", rr.Body.String())
+			}
+			if pi.Currency != tt.want {
+				t.Errorf("currency = %q, want %q", pi.Currency, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"myapp/internal/models"
+	"myapp/internal/money"
+	"net/http"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/webhook"
+)
+
+// StripeWebhook receives events from stripe, verifies the Stripe-Signature
+// header and keeps transactions and orders in step with what stripe knows
+func (app *application) StripeWebhook(w http.ResponseWriter, r *http.Request) {
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	// an empty secret would let anyone sign events, so none are handled
+	if app.config.stripe.webhookSecret == "" {
+		app.errorLog.Println("stripe webhook secret is not set")
+		resp.Error = true
+		resp.Message = "webhook is not configured"
+		app.writeJSON(w, http.StatusInternalServerError, resp)
+		return
+	}
+
+	maxBytes := 65536
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+
+	payload, err := io.ReadAll(r.Body)
+	if err != nil {
+		app.errorLog.Println(err)
+		resp.Error = true
+		resp.Message = err.Error()
+		app.writeJSON(w, http.StatusServiceUnavailable, resp)
+		return
+	}
+
+	event, err := webhook.ConstructEvent(payload, r.Header.Get("Stripe-Signature"), app.config.stripe.webhookSecret)
+	if err != nil {
+		app.errorLog.Println(err)
+		resp.Error = true
+		resp.Message = "invalid signature"
+		app.writeJSON(w, http.StatusBadRequest, resp)
+		return
+	}
+
+	// stripe delivers events at least once, so only handle each event id once
+	isNew, err := app.DB.InsertStripeEvent(event.ID, event.Type)
+	if err != nil {
+		app.errorLog.Println(err)
+		resp.Error = true
+		resp.Message = err.Error()
+		app.writeJSON(w, http.StatusInternalServerError, resp)
+		return
+	}
+	if !isNew {
+		resp.Message = "event already processed"
+		app.writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	err = app.handleStripeEvent(event)
+	if err != nil {
+		app.errorLog.Println(err)
+		// forget the event so that stripe's retry is handled again
+		if err := app.DB.DeleteStripeEvent(event.ID); err != nil {
+			app.errorLog.Println(err)
+		}
+		resp.Error = true
+		resp.Message = err.Error()
+		app.writeJSON(w, http.StatusInternalServerError, resp)
+		return
+	}
+
+	resp.Message = "event processed"
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// handleStripeEvent updates the database for the event types we care about.
+// Subscriptions are stored with the subscription id in transactions.payment_intent.
+func (app *application) handleStripeEvent(event stripe.Event) error {
+	switch event.Type {
+	case "payment_intent.succeeded":
+		var pi stripe.PaymentIntent
+		if err := json.Unmarshal(event.Data.Raw, &pi); err != nil {
+			return err
+		}
+		// a captured authorization was recorded at 0 while only held
+		if err := app.DB.CaptureTransactionByPaymentIntent(pi.ID, int(pi.AmountReceived)); err != nil {
+			return err
+		}
+		// transaction cleared
+		return app.DB.UpdateTransactionStatusByPaymentIntent(pi.ID, 2)
+
+	case "payment_intent.canceled":
+		var pi stripe.PaymentIntent
+		if err := json.Unmarshal(event.Data.Raw, &pi); err != nil {
+			return err
+		}
+		// an authorization that was voided, or whose hold expired, takes nothing
+		if err := app.DB.VoidTransactionByPaymentIntent(pi.ID); err != nil {
+			return err
+		}
+		// the customer will not pay, so let others buy the stock
+		return app.DB.ReleaseStock(pi.ID)
+
+	case "charge.refunded":
+		var charge stripe.Charge
+		if err := json.Unmarshal(event.Data.Raw, &charge); err != nil {
+			return err
+		}
+		if charge.PaymentIntent == nil {
+			return nil
+		}
+
+		order, err := app.DB.GetOrderByPaymentIntent(charge.PaymentIntent.ID)
+		if errors.Is(err, sql.ErrNoRows) {
+			// a virtual terminal charge has a transaction but no order
+			txnStatus := 4
+			if charge.AmountRefunded < charge.Amount {
+				txnStatus = 5
+			}
+			return app.DB.UpdateTransactionStatusByPaymentIntent(charge.PaymentIntent.ID, txnStatus)
+		} else if err != nil {
+			return err
+		}
+
+		// refunds made from our admin pages are already in the ledger and
+		// are skipped; ones made from the stripe dashboard are added
+		if charge.Refunds == nil {
+			return nil
+		}
+		for _, rf := range charge.Refunds.Data {
+			err = app.DB.RecordRefund(models.Refund{
+				OrderID:        order.ID,
+				Amount:         int(rf.Amount),
+				Reason:         rf.Metadata["reason"],
+				StripeRefundID: rf.ID,
+				RefundedBy:     "stripe",
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "invoice.payment_failed":
+		var invoice stripe.Invoice
+		if err := json.Unmarshal(event.Data.Raw, &invoice); err != nil {
+			return err
+		}
+		if invoice.Subscription == nil {
+			return nil
+		}
+		// transaction declined
+		err := app.DB.UpdateTransactionStatusByPaymentIntent(invoice.Subscription.ID, 3)
+		if err != nil {
+			return err
+		}
+		// the first payment is retried by the customer on the checkout page
+		if invoice.BillingReason == stripe.InvoiceBillingReasonSubscriptionCreate {
+			return nil
+		}
+		return app.chasePastDueInvoice(invoice)
+
+	case "invoice.paid":
+		var invoice stripe.Invoice
+		if err := json.Unmarshal(event.Data.Raw, &invoice); err != nil {
+			return err
+		}
+		// the zero invoice that starts a trial leaves the transaction pending
+		if invoice.Subscription == nil || invoice.AmountPaid == 0 {
+			return nil
+		}
+		// transaction cleared, with the amount of a trial's first payment
+		err := app.DB.ClearSubscriptionTransaction(invoice.Subscription.ID, int(invoice.AmountPaid))
+		if err != nil {
+			return err
+		}
+		// a past due renewal has been paid
+		return app.DB.ResolvePastDueInvoice(invoice.ID)
+
+	case "customer.subscription.trial_will_end":
+		var subscription stripe.Subscription
+		if err := json.Unmarshal(event.Data.Raw, &subscription); err != nil {
+			return err
+		}
+		return app.sendTrialEndingMail(subscription)
+
+	case "customer.subscription.updated":
+		var subscription stripe.Subscription
+		if err := json.Unmarshal(event.Data.Raw, &subscription); err != nil {
+			return err
+		}
+		// keep pauses and pending cancellations made in the stripe dashboard in step
+		switch {
+		case subscription.PauseCollection.Behavior != "":
+			// paused
+			return app.DB.UpdateSubscriptionStatus(subscription.ID, 5)
+		case subscription.CancelAtPeriodEnd:
+			// pending cancellation
+			return app.DB.UpdateSubscriptionStatus(subscription.ID, 4)
+		case subscription.Status == stripe.SubscriptionStatusTrialing:
+			// trialing
+			return app.DB.UpdateSubscriptionStatus(subscription.ID, 6)
+		case subscription.Status == stripe.SubscriptionStatusPastDue:
+			// past due
+			return app.DB.UpdateSubscriptionStatus(subscription.ID, 7)
+		case subscription.Status == stripe.SubscriptionStatusActive:
+			// cleared
+			return app.DB.UpdateSubscriptionStatus(subscription.ID, 1)
+		}
+		return nil
+
+	case "customer.subscription.deleted":
+		var subscription stripe.Subscription
+		if err := json.Unmarshal(event.Data.Raw, &subscription); err != nil {
+			return err
+		}
+		// order cancelled
+		return app.DB.UpdateOrderStatusByPaymentIntent(subscription.ID, 3)
+
+	default:
+		app.infoLog.Println("unhandled stripe event", event.Type)
+	}
+	return nil
+}
+
+// sendTrialEndingMail reminds the customer that their trial is about to turn
+// into a paid subscription. Stripe sends the event three days before.
+func (app *application) sendTrialEndingMail(subscription stripe.Subscription) error {
+	order, err := app.DB.GetOrderByPaymentIntent(subscription.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// nothing to remind about once the customer has cancelled
+	if order.StatusID != 6 {
+		return nil
+	}
+
+	widget, err := app.DB.GetWidget(order.WidgetID)
+	if err != nil {
+		return err
+	}
+
+	var data struct {
+		FirstName string
+		Plan      string
+		Amount    money.Money
+		TrialEnd  string
+	}
+	data.FirstName = order.Customer.FirstName
+	data.Plan = widget.Name
+	data.Amount = order.Money()
+	data.TrialEnd = time.Unix(subscription.TrialEnd, 0).Format("02-01-2006")
+
+	return app.SendMail("info@widgets.com", order.Customer.Email, "Your free trial is ending soon", "trial-ending", data)
+}
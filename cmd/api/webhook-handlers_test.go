@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/webhook"
+)
+
+// webhookRequest builds a stripe event delivery signed with secret
+func webhookRequest(id, eventType, object, secret string) *http.Request {
+	payload := []byte(fmt.Sprintf(`{"id": %q, "object": "event", "type": %q, "api_version": %q, "data": {"object": %s}}`,
+		id, eventType, stripe.APIVersion, object))
+
+	now := time.Now()
+	signature := hex.EncodeToString(webhook.ComputeSignature(now, payload, secret))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/webhook", bytes.NewReader(payload))
+	req.Header.Set("Stripe-Signature", fmt.Sprintf("t=%d,v1=%s", now.Unix(), signature))
+	return req
+}
+
+const succeededIntent = `{"id": "pi_1", "object": "payment_intent", "amount": 5000, "amount_received": 5000, "status": "succeeded"}`
+
+func TestStripeWebhookBadSignature(t *testing.T) {
+	app, _, _ := newTestApp(t)
+
+	rr := httptest.NewRecorder()
+	app.StripeWebhook(rr, webhookRequest("evt_1", "payment_intent.succeeded", succeededIntent, "whsec_other"))
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestStripeWebhookWithoutSecret(t *testing.T) {
+	app, _, _ := newTestApp(t)
+	app.config.stripe.webhookSecret = ""
+
+	// an event signed with the empty secret must not be handled
+	rr := httptest.NewRecorder()
+	app.StripeWebhook(rr, webhookRequest("evt_1", "payment_intent.succeeded", succeededIntent, ""))
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestStripeWebhookPaymentIntentSucceeded(t *testing.T) {
+	app, mock, _ := newTestApp(t)
+
+	mock.ExpectExec(regexp.QuoteMeta("INSERT IGNORE INTO stripe_events")).
+		WithArgs("evt_1", "payment_intent.succeeded", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE transactions SET amount = ?, transaction_status_id = 2")).
+		WithArgs(5000, sqlmock.AnyArg(), "pi_1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE transactions SET transaction_status_id = ?")).
+		WithArgs(2, sqlmock.AnyArg(), "pi_1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	rr := httptest.NewRecorder()
+	app.StripeWebhook(rr, webhookRequest("evt_1", "payment_intent.succeeded", succeededIntent, "whsec_test"))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	if _, msg := decodeResponse(t, rr); msg != "event processed" {
+		t.Errorf("message = %q, want %q", msg, "event processed")
+	}
+}
+
+func TestStripeWebhookDuplicateEvent(t *testing.T) {
+	app, mock, _ := newTestApp(t)
+
+	// the event id is already in stripe_events, so nothing else is touched
+	mock.ExpectExec(regexp.QuoteMeta("INSERT IGNORE INTO stripe_events")).
+		WithArgs("evt_1", "payment_intent.succeeded", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	rr := httptest.NewRecorder()
+	app.StripeWebhook(rr, webhookRequest("evt_1", "payment_intent.succeeded", succeededIntent, "whsec_test"))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	if _, msg := decodeResponse(t, rr); msg != "event already processed" {
+		t.Errorf("message = %q, want %q", msg, "event already processed")
+	}
+}
+
+func TestStripeWebhookHandlerErrorForgetsEvent(t *testing.T) {
+	app, mock, _ := newTestApp(t)
+
+	mock.ExpectExec(regexp.QuoteMeta("INSERT IGNORE INTO stripe_events")).
+		WithArgs("evt_1", "payment_intent.succeeded", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE transactions SET amount = ?, transaction_status_id = 2")).
+		WithArgs(5000, sqlmock.AnyArg(), "pi_1").
+		WillReturnError(errors.New("connection lost"))
+	// stripe's retry must be handled again
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM stripe_events WHERE event_id = ?")).
+		WithArgs("evt_1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	rr := httptest.NewRecorder()
+	app.StripeWebhook(rr, webhookRequest("evt_1", "payment_intent.succeeded", succeededIntent, "whsec_test"))
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusInternalServerError)
+	}
+}
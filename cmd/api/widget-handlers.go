@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"myapp/internal/models"
+	"myapp/internal/money"
+	"myapp/internal/validator"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// currencyCode is a lower case ISO 4217 currency code
+var currencyCode = regexp.MustCompile(`^[a-z]{3}$`)
+
+// maxImageSize is the largest widget image that may be uploaded
+const maxImageSize = 2 << 20
+
+// imageTypes maps the content types accepted for widget images to a file extension
+var imageTypes = map[string]string{
+	"image/jpeg": ".jpeg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// AllWidgets returns every widget, retired ones included
+func (app *application) AllWidgets(w http.ResponseWriter, r *http.Request) {
+	widgets, err := app.DB.GetAllWidgets()
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+	app.writeJSON(w, http.StatusOK, widgets)
+}
+
+// OneWidget returns one widget
+func (app *application) OneWidget(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	widgetID, err := strconv.Atoi(id)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	widget, err := app.DB.GetWidget(widgetID)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+	app.writeJSON(w, http.StatusOK, widget)
+}
+
+// EditWidget adds a widget when id is 0 and updates it otherwise
+func (app *application) EditWidget(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	widgetID, err := strconv.Atoi(id)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var widget models.Widget
+	err = app.readJSON(w, r, &widget)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+	widget.ID = widgetID
+	widget.Name = strings.TrimSpace(widget.Name)
+	widget.PlanID = strings.TrimSpace(widget.PlanID)
+
+	v := validator.New()
+	v.Check(widget.Name != "", "name", "must be provided")
+	v.Check(len(widget.Name) <= 255, "name", "must be at most 255 characters")
+	v.Check(widget.Price > 0, "price", "must be greater than zero")
+	v.Check(widget.InventoryLevel >= 0, "inventory_level", "must not be negative")
+	v.Check(!widget.IsRecurring || widget.PlanID != "", "plan_id", "must be provided for a recurring widget")
+	v.Check(widget.IsRecurring || widget.PlanID == "", "plan_id", "must be empty unless the widget is recurring")
+	v.Check(widget.TrialDays >= 0 && widget.TrialDays <= 730, "trial_days", "must be between 0 and 730")
+	v.Check(widget.IsRecurring || widget.TrialDays == 0, "trial_days", "must be 0 unless the widget is recurring")
+	v.Check(widget.Image == "" || strings.HasPrefix(widget.Image, "/static/"), "image", "must be an uploaded image")
+
+	// the price in the default currency is Price; Prices only holds the others
+	seen := make(map[string]bool)
+	for i, p := range widget.Prices {
+		p.Currency = strings.ToLower(strings.TrimSpace(p.Currency))
+		widget.Prices[i].Currency = p.Currency
+		v.Check(currencyCode.MatchString(p.Currency), "prices", "must each have a three letter currency code")
+		v.Check(p.Currency != money.DefaultCurrency, "prices", fmt.Sprintf("must not include %s, which is the main price", strings.ToUpper(money.DefaultCurrency)))
+		v.Check(!seen[p.Currency], "prices", fmt.Sprintf("must not repeat %s", strings.ToUpper(p.Currency)))
+		v.Check(p.Price > 0, "prices", "must each be greater than zero")
+		seen[p.Currency] = true
+	}
+
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+		ID      int    `json:"id"`
+	}
+
+	if widgetID > 0 {
+		_, err = app.DB.GetWidget(widgetID)
+		if err != nil {
+			app.errorLog.Println(err)
+			app.badRequest(w, r, err)
+			return
+		}
+		err = app.DB.EditWidget(widget)
+		if err != nil {
+			app.errorLog.Println(err)
+			app.badRequest(w, r, err)
+			return
+		}
+		resp.ID = widgetID
+		resp.Message = "Widget saved"
+	} else {
+		resp.ID, err = app.DB.AddWidget(widget)
+		if err != nil {
+			app.errorLog.Println(err)
+			app.badRequest(w, r, err)
+			return
+		}
+		resp.Message = "Widget added"
+	}
+
+	resp.Error = false
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// RetireWidget takes a widget off sale
+func (app *application) RetireWidget(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	widgetID, err := strconv.Atoi(id)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.RetireWidget(widgetID)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	resp.Error = false
+	resp.Message = "Widget retired"
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// UploadWidgetImage saves an uploaded widget image under the static directory
+// and returns the path to store in the widget's image
+func (app *application) UploadWidgetImage(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImageSize+4096)
+
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, errors.New("image must be a file of at most 2MB"))
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxImageSize+1))
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(len(data) > 0, "image", "must not be empty")
+	v.Check(len(data) <= maxImageSize, "image", "must be at most 2MB")
+
+	// trust the bytes, not the file name or the browser's content type
+	ext, ok := imageTypes[http.DetectContentType(data)]
+	v.Check(ok, "image", "must be a jpeg, png, gif or webp image")
+
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	name := make([]byte, 16)
+	_, err = rand.Read(name)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+	fileName := hex.EncodeToString(name) + ext
+
+	dir := filepath.Join(app.config.static, "widgets")
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = os.WriteFile(filepath.Join(dir, fileName), data, 0644)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+		Image   string `json:"image"`
+	}
+	resp.Error = false
+	resp.Message = "Image uploaded"
+	resp.Image = fmt.Sprintf("/static/widgets/%s", fileName)
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
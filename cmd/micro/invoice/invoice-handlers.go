@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"myapp/internal/money"
+	"myapp/internal/tax"
 	"net/http"
 	"time"
 
@@ -11,14 +13,29 @@ import (
 
 //Order type for all orders
 type Order struct {
-	ID        int       `json:"id"`
-	Quantity  int       `json:"quantity"`
-	Amount    int       `json:"amount"`
-	Product   string    `json:"product"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Email     string    `json:"email"`
-	CreatedAt time.Time `json:"created_at"`
+	ID        int         `json:"id"`
+	Quantity  int         `json:"quantity"`
+	Amount    int         `json:"amount"`
+	Currency  string      `json:"currency"`
+	Product   string      `json:"product"`
+	FirstName string      `json:"first_name"`
+	LastName  string      `json:"last_name"`
+	Email     string      `json:"email"`
+	CreatedAt time.Time   `json:"created_at"`
+	Items     []OrderItem `json:"items"`
+	Discount  int         `json:"discount"`
+	Coupon    string      `json:"coupon"`
+	TaxLines  []tax.Line  `json:"tax_lines"`
+	TaxState  string      `json:"tax_state"`
+	//SellerState is the state the API split TaxLines from
+	SellerState string `json:"seller_state"`
+}
+
+//OrderItem is one line of an order
+type OrderItem struct {
+	Product  string `json:"product"`
+	Quantity int    `json:"quantity"`
+	Amount   int    `json:"amount"`
 }
 
 func (app *application) CreateAndSendInvoice(w http.ResponseWriter, r *http.Request) {
@@ -30,6 +47,11 @@ func (app *application) CreateAndSendInvoice(w http.ResponseWriter, r *http.Requ
 		app.badRequest(w, r, err)
 		return
 	}
+	//an invoice must not show CGST and SGST under another state's GSTIN
+	if len(order.TaxLines) > 0 && app.config.gstin != "" && order.SellerState != app.config.gstin[:2] {
+		app.badRequest(w, r, fmt.Errorf("GSTIN %s is registered in state %s, but the tax was charged from state %q", app.config.gstin, app.config.gstin[:2], order.SellerState))
+		return
+	}
 	//generate a PDF invoice
 	err = app.createInvoicePDF(order)
 	if err != nil {
@@ -84,16 +106,69 @@ func (app *application) createInvoicePDF(order Order) error {
 	pdf.Ln(5)
 	pdf.CellFormat(97, 8, order.CreatedAt.Format("02-01-2006"), "", 0, "L", false, 0, "")
 
-	//writing in table
-	pdf.SetX(58)
-	pdf.SetY(93)
-	pdf.CellFormat(155, 8, order.Product, "", 0, "L", false, 0, "")
+	//seller's GST registration and where the sale was made, beside the customer
+	if app.config.gstin != "" {
+		pdf.SetY(50)
+		pdf.SetX(108)
+		pdf.CellFormat(97, 8, fmt.Sprintf("GSTIN: %s", app.config.gstin), "", 0, "R", false, 0, "")
+	}
+	if state, ok := tax.LookupState(order.TaxState); ok {
+		pdf.SetY(55)
+		pdf.SetX(108)
+		pdf.CellFormat(97, 8, fmt.Sprintf("Place of supply: %s (%s)", state.Name, state.Code), "", 0, "R", false, 0, "")
+	}
+
+	//amounts are in the minor unit of the order's currency; the pdf font has no rupee sign, so the code is printed
+	price := func(amount int) string {
+		return money.New(amount, order.Currency).Text()
+	}
+
+	//writing in table, one row per item
+	items := order.Items
+	if len(items) == 0 {
+		items = []OrderItem{{Product: order.Product, Quantity: order.Quantity, Amount: order.Amount}}
+	}
+	for i, item := range items {
+		pdf.SetX(58)
+		pdf.SetY(93 + float64(i*8))
+		pdf.CellFormat(155, 8, item.Product, "", 0, "L", false, 0, "")
+
+		pdf.SetX(166)
+		pdf.CellFormat(20, 8, fmt.Sprintf("%d", item.Quantity), "", 0, "C", false, 0, "")
+
+		pdf.SetX(185)
+		pdf.CellFormat(20, 8, price(item.Amount), "", 0, "R", false, 0, "")
+	}
 
-	pdf.SetX(166)
-	pdf.CellFormat(20, 8, fmt.Sprintf("%d", order.Quantity), "", 0, "C", false, 0, "")
+	//the coupon discount goes under the items it came off, then the tax on what is left
+	row := len(items)
+	if order.Discount > 0 {
+		pdf.SetX(58)
+		pdf.SetY(93 + float64(row*8))
+		pdf.CellFormat(155, 8, fmt.Sprintf("Discount (%s)", order.Coupon), "", 0, "L", false, 0, "")
 
-	pdf.SetX(185)
-	pdf.CellFormat(20, 8, fmt.Sprintf("$%.2f", float32(order.Amount)), "", 0, "R", false, 0, "")
+		pdf.SetX(185)
+		pdf.CellFormat(20, 8, price(-order.Discount), "", 0, "R", false, 0, "")
+		row++
+	}
+	for _, line := range order.TaxLines {
+		pdf.SetX(58)
+		pdf.SetY(93 + float64(row*8))
+		pdf.CellFormat(155, 8, fmt.Sprintf("%s @ %s", line.Name, line.Percent()), "", 0, "L", false, 0, "")
+
+		pdf.SetX(185)
+		pdf.CellFormat(20, 8, price(line.Amount), "", 0, "R", false, 0, "")
+		row++
+	}
+	if row > len(items) {
+		pdf.SetX(58)
+		pdf.SetY(93 + float64(row*8))
+		pdf.SetFont("Times", "B", 11)
+		pdf.CellFormat(155, 8, "Total", "", 0, "L", false, 0, "")
+
+		pdf.SetX(185)
+		pdf.CellFormat(20, 8, price(order.Amount), "", 0, "R", false, 0, "")
+	}
 
 	invoicePath := fmt.Sprintf("./invoices/%d.pdf", order.ID)
 
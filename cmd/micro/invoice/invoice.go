@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"myapp/internal/tax"
 	"net/http"
 	"os"
 	"time"
@@ -21,6 +22,9 @@ type config struct {
 		password string
 	}
 	frontEnd string
+	// gstin is the seller's GST registration printed on every invoice. Taxed
+	// orders must come from the state it is registered in.
+	gstin string
 }
 type application struct {
 	config   config
@@ -39,8 +43,16 @@ func main() {
 	flag.StringVar(&cfg.smtp.password, "smtppass", "32886bcc818409", "smtp password")
 	flag.StringVar(&cfg.frontEnd, "frontend", "http://localhost:4000", "url to front end")
 
+	flag.StringVar(&cfg.gstin, "gstin", "", "seller's GSTIN to print on invoices")
+
 	flag.Parse()
 
+	if cfg.gstin != "" {
+		if err := tax.CheckGSTIN(cfg.gstin); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
 	errorLog := log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
 
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"myapp/internal/models"
+	"myapp/internal/urlsigner"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// invoicePath is where the invoice microservice writes the pdf for an order
+func invoicePath(orderID int) string {
+	return fmt.Sprintf("./invoices/%d.pdf", orderID)
+}
+
+// CustomerAuth lets through customers who signed in with an emailed link
+func (app *application) CustomerAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.Session.Exists(r.Context(), "customerEmail") {
+			http.Redirect(w, r, "/account/login", http.StatusSeeOther)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// customerToken signs the email of the signed in customer for the API, which
+// only bills a returning customer's stripe customer when shown one
+func (app *application) customerToken(email string) string {
+	signer := urlsigner.Signer{
+		Secret: []byte(app.config.secretKey),
+	}
+	link := fmt.Sprintf("%s/customer?email=%s", app.config.frontEnd, url.QueryEscape(email))
+	return signer.GenerateTokenFromString(link)
+}
+
+// customerOrder returns an order if it belongs to the signed in customer
+func (app *application) customerOrder(r *http.Request) (models.Order, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		return models.Order{}, err
+	}
+	order, err := app.DB.GetOrderById(id)
+	if err != nil {
+		return order, err
+	}
+	if !strings.EqualFold(order.Customer.Email, app.Session.GetString(r.Context(), "customerEmail")) {
+		return models.Order{}, fmt.Errorf("order %d does not belong to the signed in customer", id)
+	}
+	return order, nil
+}
+
+// CustomerLogin shows the form that emails a customer a sign in link
+func (app *application) CustomerLogin(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "customer-login", &templateDate{
+		Flash: app.Session.PopString(r.Context(), "flash"),
+	}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// VerifyCustomerLogin signs a customer in from the link emailed to them
+func (app *application) VerifyCustomerLogin(w http.ResponseWriter, r *http.Request) {
+	testURL := fmt.Sprintf("%s%s", app.config.frontEnd, r.RequestURI)
+
+	signer := urlsigner.Signer{
+		Secret: []byte(app.config.secretKey),
+	}
+	if !signer.VerifyToken(testURL) {
+		app.errorLog.Println("Invalid URL - tampering detected")
+		http.Redirect(w, r, "/account/login", http.StatusSeeOther)
+		return
+	}
+	if signer.Expired(testURL, 60) {
+		app.errorLog.Println("Link Expired")
+		app.Session.Put(r.Context(), "flash", "That link has expired, please ask for a new one")
+		http.Redirect(w, r, "/account/login", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.RenewToken(r.Context())
+	app.Session.Put(r.Context(), "customerEmail", r.URL.Query().Get("email"))
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+// CustomerLogout signs the customer out, keeping their cart
+func (app *application) CustomerLogout(w http.ResponseWriter, r *http.Request) {
+	app.Session.Remove(r.Context(), "customerEmail")
+	app.Session.RenewToken(r.Context())
+	http.Redirect(w, r, "/account/login", http.StatusSeeOther)
+}
+
+// Account lists the signed in customer's orders and subscriptions
+func (app *application) Account(w http.ResponseWriter, r *http.Request) {
+	email := app.Session.GetString(r.Context(), "customerEmail")
+
+	orders, err := app.DB.GetOrdersForCustomerEmail(email)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	var purchases, subscriptions []*models.Order
+	invoices := make(map[int]bool)
+	for _, o := range orders {
+		if o.Widget.IsRecurring {
+			subscriptions = append(subscriptions, o)
+		} else {
+			purchases = append(purchases, o)
+		}
+		if _, err := os.Stat(invoicePath(o.ID)); err == nil {
+			invoices[o.ID] = true
+		}
+	}
+
+	data := make(map[string]interface{})
+	data["email"] = email
+	data["orders"] = purchases
+	data["subscriptions"] = subscriptions
+	data["invoices"] = invoices
+
+	if err := app.renderTemplate(w, r, "customer-account", &templateDate{
+		Data:  data,
+		Flash: app.Session.PopString(r.Context(), "flash"),
+	}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// CustomerInvoice downloads the invoice pdf for one of the customer's orders
+func (app *application) CustomerInvoice(w http.ResponseWriter, r *http.Request) {
+	order, err := app.customerOrder(r)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.NotFound(w, r)
+		return
+	}
+
+	path := invoicePath(order.ID)
+	if _, err := os.Stat(path); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=invoice-%d.pdf", order.ID))
+	http.ServeFile(w, r, path)
+}
+
+// CustomerCancelSubscription cancels one of the customer's subscriptions at
+// the end of the period they have paid for
+func (app *application) CustomerCancelSubscription(w http.ResponseWriter, r *http.Request) {
+	order, err := app.customerOrder(r)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.NotFound(w, r)
+		return
+	}
+
+	widget, err := app.DB.GetWidget(order.WidgetID)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.NotFound(w, r)
+		return
+	}
+
+	// cleared, paused, trialing or past due; pending cancellations are already cancelling
+	if !widget.IsRecurring || (order.StatusID != 1 && order.StatusID != 5 && order.StatusID != 6 && order.StatusID != 7) {
+		app.Session.Put(r.Context(), "flash", "That subscription can not be cancelled")
+		http.Redirect(w, r, "/account", http.StatusSeeOther)
+		return
+	}
+
+	err = app.Gateway.CancelSubscription(order.Transaction.PaymentIntent)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.Session.Put(r.Context(), "flash", "We could not cancel your subscription, please try again")
+		http.Redirect(w, r, "/account", http.StatusSeeOther)
+		return
+	}
+
+	// pending cancellation; the webhook marks it cancelled when the period ends
+	err = app.DB.UpdateOrderStatus(order.ID, 4)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	app.Session.Put(r.Context(), "flash", fmt.Sprintf("Your %s subscription will end at the end of the current period", widget.Name))
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+// UpdateCardLink opens the card page of a subscription from the link in a
+// failed payment email. The link is valid for as many minutes as the API
+// signed into it and opens only that card page, not the customer's account.
+func (app *application) UpdateCardLink(w http.ResponseWriter, r *http.Request) {
+	testURL := fmt.Sprintf("%s%s", app.config.frontEnd, r.RequestURI)
+
+	signer := urlsigner.Signer{
+		Secret: []byte(app.config.secretKey),
+	}
+	if !signer.VerifyToken(testURL) {
+		app.errorLog.Println("Invalid URL - tampering detected")
+		http.Redirect(w, r, "/account/login", http.StatusSeeOther)
+		return
+	}
+	valid, _ := strconv.Atoi(r.URL.Query().Get("valid"))
+	if signer.Expired(testURL, valid) {
+		app.errorLog.Println("Link Expired")
+		app.Session.Put(r.Context(), "flash", "That link has expired, please sign in to update your card")
+		http.Redirect(w, r, "/account/login", http.StatusSeeOther)
+		return
+	}
+
+	orderID, _ := strconv.Atoi(r.URL.Query().Get("order"))
+	order, err := app.DB.GetOrderById(orderID)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Redirect(w, r, "/account/login", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.RenewToken(r.Context())
+	app.Session.Put(r.Context(), "cardOrderID", order.ID)
+	http.Redirect(w, r, fmt.Sprintf("/account/subscriptions/%d/card", order.ID), http.StatusSeeOther)
+}
+
+// cardOrder returns the order whose card page was asked for. A signed in
+// customer can open any of their orders; a failed payment email link opens
+// only the order it was sent for.
+func (app *application) cardOrder(r *http.Request) (models.Order, error) {
+	if app.Session.Exists(r.Context(), "customerEmail") {
+		return app.customerOrder(r)
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		return models.Order{}, err
+	}
+	if app.Session.GetInt(r.Context(), "cardOrderID") != id {
+		return models.Order{}, fmt.Errorf("order %d was not opened from its update card link", id)
+	}
+	return app.DB.GetOrderById(id)
+}
+
+// SubscriptionCard shows the form to change the card a subscription is
+// charged to, and to pay an overdue renewal with it
+func (app *application) SubscriptionCard(w http.ResponseWriter, r *http.Request) {
+	if !app.Session.Exists(r.Context(), "customerEmail") && !app.Session.Exists(r.Context(), "cardOrderID") {
+		http.Redirect(w, r, "/account/login", http.StatusSeeOther)
+		return
+	}
+	order, err := app.cardOrder(r)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.NotFound(w, r)
+		return
+	}
+
+	widget, err := app.DB.GetWidget(order.WidgetID)
+	if err != nil || !widget.IsRecurring {
+		app.errorLog.Println("not a subscription", order.ID, err)
+		http.NotFound(w, r)
+		return
+	}
+
+	// the API only changes the card of the order signed for here
+	signer := urlsigner.Signer{
+		Secret: []byte(app.config.secretKey),
+	}
+	link := fmt.Sprintf("%s/subscription-card?order=%d", app.config.frontEnd, order.ID)
+
+	data := make(map[string]interface{})
+	data["order"] = order
+	data["widget"] = widget
+	data["token"] = signer.GenerateTokenFromString(link)
+
+	if err := app.renderTemplate(w, r, "subscription-card", &templateDate{
+		Data: data,
+	}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
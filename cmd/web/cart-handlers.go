@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"myapp/internal/cards"
+	"myapp/internal/models"
+	"myapp/internal/money"
+	"net/http"
+	"strconv"
+)
+
+// Cart is the shopping cart kept in the session. Prices are not stored; they
+// are read from the database whenever the cart is shown or paid for.
+type Cart struct {
+	Items []cards.LineItem
+}
+
+// CartLine is one cart item with its widget, for display
+type CartLine struct {
+	Widget   models.Widget
+	Quantity int
+	Total    int
+}
+
+// getCart returns the cart for this session, which may be empty
+func (app *application) getCart(r *http.Request) Cart {
+	cart, _ := app.Session.Get(r.Context(), "cart").(Cart)
+	return cart
+}
+
+// setQuantity sets the quantity of a widget in the cart; zero removes it
+func (c *Cart) setQuantity(widgetID, quantity int) {
+	for i, item := range c.Items {
+		if item.WidgetID == widgetID {
+			if quantity <= 0 {
+				c.Items = append(c.Items[:i], c.Items[i+1:]...)
+			} else {
+				c.Items[i].Quantity = quantity
+			}
+			return
+		}
+	}
+	if quantity > 0 {
+		c.Items = append(c.Items, cards.LineItem{WidgetID: widgetID, Quantity: quantity})
+	}
+}
+
+// quantity returns how many of a widget are in the cart
+func (c *Cart) quantity(widgetID int) int {
+	for _, item := range c.Items {
+		if item.WidgetID == widgetID {
+			return item.Quantity
+		}
+	}
+	return 0
+}
+
+// ShowCart displays the cart and the checkout form
+func (app *application) ShowCart(w http.ResponseWriter, r *http.Request) {
+	cart := app.getCart(r)
+
+	var lines []CartLine
+	total := 0
+	for _, item := range cart.Items {
+		widget, err := app.DB.GetWidget(item.WidgetID)
+		if err != nil {
+			app.errorLog.Println(err)
+			continue
+		}
+		widget.Available, err = app.DB.GetAvailableStock(widget.ID)
+		if err != nil {
+			app.errorLog.Println(err)
+			continue
+		}
+		line := CartLine{
+			Widget:   widget,
+			Quantity: item.Quantity,
+			Total:    widget.Price * item.Quantity,
+		}
+		total += line.Total
+		lines = append(lines, line)
+	}
+
+	items, err := json.Marshal(cart.Items)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	stringMap := make(map[string]string)
+	stringMap["cart-items"] = string(items)
+
+	intMap := make(map[string]int)
+	intMap["total"] = total
+
+	data := make(map[string]interface{})
+	data["lines"] = lines
+	data["prices"] = cartTotals(lines)
+	data["saved-cards"] = app.savedCards(r)
+
+	if err := app.renderTemplate(w, r, "cart", &templateDate{
+		StringMap: stringMap,
+		IntMap:    intMap,
+		Data:      data,
+	}, "stripe-js"); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// cartTotals returns the cart total in every currency all of its widgets are
+// sold in, which are the currencies the cart can be paid in
+func cartTotals(lines []CartLine) []money.Money {
+	var totals []money.Money
+	for i, line := range lines {
+		if i == 0 {
+			for _, price := range line.Widget.AllPrices() {
+				totals = append(totals, money.New(price.Amount*line.Quantity, price.Currency))
+			}
+			continue
+		}
+		var kept []money.Money
+		for _, total := range totals {
+			if price, ok := line.Widget.PriceIn(total.Currency); ok {
+				total.Amount += price * line.Quantity
+				kept = append(kept, total)
+			}
+		}
+		totals = kept
+	}
+	return totals
+}
+
+// AddToCart adds a quantity of a widget to the cart
+func (app *application) AddToCart(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	widgetID, err := strconv.Atoi(r.Form.Get("product_id"))
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+	quantity, err := strconv.Atoi(r.Form.Get("quantity"))
+	if err != nil || quantity < 1 {
+		quantity = 1
+	}
+
+	widget, err := app.DB.GetWidget(widgetID)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+	if widget.IsRecurring || !widget.IsActive {
+		// subscriptions are bought on their own plan page, and retired widgets not at all
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+
+	cart := app.getCart(r)
+	quantity += cart.quantity(widget.ID)
+
+	available, err := app.DB.GetAvailableStock(widget.ID)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+	if quantity > available {
+		quantity = available
+	}
+
+	cart.setQuantity(widget.ID, quantity)
+	app.Session.Put(r.Context(), "cart", cart)
+
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
+
+// UpdateCart changes the quantity of a widget in the cart; a quantity of zero removes it
+func (app *application) UpdateCart(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	widgetID, err := strconv.Atoi(r.Form.Get("product_id"))
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+	quantity, err := strconv.Atoi(r.Form.Get("quantity"))
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+
+	cart := app.getCart(r)
+	cart.setQuantity(widgetID, quantity)
+	app.Session.Put(r.Context(), "cart", cart)
+
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
@@ -2,18 +2,22 @@ package main
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"myapp/internal/cards"
 	"myapp/internal/encryption"
 	"myapp/internal/models"
+	"myapp/internal/tax"
 	"myapp/internal/urlsigner"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/stripe/stripe-go/v72"
 )
 
 //Displays the home page
@@ -31,6 +35,20 @@ func (app *application) VirtualTerminal(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+//TerminalSales shows the payments taken in the virtual terminal
+func (app *application) TerminalSales(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "terminal-sales", &templateDate{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+//TerminalSale shows one virtual terminal payment, where an authorization is captured or voided
+func (app *application) TerminalSale(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "terminal-sale", &templateDate{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
 //transaction type for transactionData
 type TransactionData struct {
 	FirstName       string
@@ -44,6 +62,20 @@ type TransactionData struct {
 	ExpiryMonth     int
 	ExpiryYear      int
 	BankReturnCode  string
+	Items           []models.OrderItem
+	// CardBrand and CardSaved describe the card, and whether it is now saved to StripeCustomerID
+	CardBrand        string
+	CardSaved        bool
+	StripeCustomerID string
+	// Discount is what CouponCode took off the items
+	Discount   int
+	CouponID   int
+	CouponCode string
+	// TaxLines are the GST charged on a sale to TaxState, included in PaymentAmount,
+	// by a seller in TaxSellerState
+	TaxLines       []tax.Line
+	TaxState       string
+	TaxSellerState string
 }
 
 //GetTransactionData get transaction data from post and stripe
@@ -61,26 +93,16 @@ func (app *application) GetTransactionData(r *http.Request) (TransactionData, er
 	email := r.Form.Get("email")
 	paymentIntent := r.Form.Get("payment_intent")
 	paymentMethod := r.Form.Get("payment_method")
-	paymentAmount := r.Form.Get("payment_amount")
-	paymentCurrency := r.Form.Get("payment_currency")
 
-	// create transaction
-	amount, err := strconv.Atoi(paymentAmount)
-	if err != nil {
-		app.errorLog.Println(err)
-	}
-
-	card := cards.Card{
-		Secret: app.config.stripe.secret,
-		Key:    app.config.stripe.key,
-	}
-
-	pi, err := card.RetrievePaymentIntent(paymentIntent)
+	pi, err := app.Gateway.RetrievePaymentIntent(paymentIntent)
 	if err != nil {
 		app.errorLog.Println(err)
 		return txnData, err
 	}
-	pm, err := card.GetPaymentMethod(paymentMethod)
+	if pi.Status != stripe.PaymentIntentStatusSucceeded {
+		return txnData, fmt.Errorf("payment intent %s has status %s", pi.ID, pi.Status)
+	}
+	pm, err := app.Gateway.GetPaymentMethod(paymentMethod)
 	if err != nil {
 		app.errorLog.Println(err)
 		return txnData, err
@@ -89,32 +111,85 @@ func (app *application) GetTransactionData(r *http.Request) (TransactionData, er
 	expiryMonth := pm.Card.ExpMonth
 	expiryYear := pm.Card.ExpYear
 
+	// amount, currency and items are what stripe charged for, not what the form says
+	lineItems, err := cards.ParseLineItems(pi.Metadata["items"])
+	if err != nil {
+		// payment intents made before the cart carry a single widget
+		lineItems = nil
+		widgetID, _ := strconv.Atoi(pi.Metadata["widget_id"])
+		quantity, err := strconv.Atoi(pi.Metadata["quantity"])
+		if err != nil {
+			quantity = 1
+		}
+		if widgetID > 0 {
+			lineItems = []cards.LineItem{{WidgetID: widgetID, Quantity: quantity}}
+		}
+	}
+	var items []models.OrderItem
+	for _, item := range lineItems {
+		items = append(items, models.OrderItem{WidgetID: item.WidgetID, Quantity: item.Quantity, Price: item.Price})
+	}
+
 	txnData = TransactionData{
 		FirstName:       firstName,
 		LastName:        lastName,
 		Email:           email,
 		PaymentIntentID: paymentIntent,
 		PaymentMethodID: paymentMethod,
-		PaymentAmount:   amount,
-		PaymentCurrency: paymentCurrency,
+		PaymentAmount:   int(pi.Amount),
+		PaymentCurrency: pi.Currency,
 		LastFour:        lastFour,
 		ExpiryMonth:     int(expiryMonth),
 		ExpiryYear:      int(expiryYear),
-		BankReturnCode:  pi.Charges.Data[0].ID,
+		BankReturnCode:  cards.ChargeID(pi),
+		Items:           items,
+		CardBrand:       string(pm.Card.Brand),
+	}
+	// the API only puts a coupon on a payment intent after checking it
+	if discount, err := strconv.Atoi(pi.Metadata["discount"]); err == nil && discount > 0 {
+		txnData.Discount = discount
+		txnData.CouponID, _ = strconv.Atoi(pi.Metadata["coupon_id"])
+		txnData.CouponCode = pi.Metadata["coupon"]
+	}
+	txnData.TaxLines, err = tax.ParseLines(pi.Metadata["tax"])
+	if err != nil {
+		return txnData, err
+	}
+	txnData.TaxState = pi.Metadata["tax_state"]
+	txnData.TaxSellerState = pi.Metadata["tax_seller_state"]
+	// a card paid with on a stripe customer stays attached to it
+	if pm.Customer != nil && pi.Customer != nil && pm.Customer.ID == pi.Customer.ID {
+		txnData.CardSaved = true
+		txnData.StripeCustomerID = pi.Customer.ID
 	}
 	return txnData, nil
 }
 
 //Invoice describes the JSON payload sent to the microservices
 type Invoice struct {
-	ID        int       `json:"id"`
-	Quantity  int       `json:"quantity"`
-	Amount    int       `json:"amount"`
-	Product   string    `json:"product"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Email     string    `json:"email"`
-	CreatedAt time.Time `json:"created_at"`
+	ID        int           `json:"id"`
+	Quantity  int           `json:"quantity"`
+	Amount    int           `json:"amount"`
+	Currency  string        `json:"currency"`
+	Product   string        `json:"product"`
+	FirstName string        `json:"first_name"`
+	LastName  string        `json:"last_name"`
+	Email     string        `json:"email"`
+	CreatedAt time.Time     `json:"created_at"`
+	Items     []InvoiceItem `json:"items,omitempty"`
+	Discount  int           `json:"discount,omitempty"`
+	Coupon    string        `json:"coupon,omitempty"`
+	TaxLines  []tax.Line    `json:"tax_lines,omitempty"`
+	TaxState  string        `json:"tax_state,omitempty"`
+	// SellerState is the state the API split TaxLines from
+	SellerState string `json:"seller_state,omitempty"`
+}
+
+//InvoiceItem is one line of an invoice
+type InvoiceItem struct {
+	Product  string `json:"product"`
+	Quantity int    `json:"quantity"`
+	Amount   int    `json:"amount"`
 }
 
 // PaymentSucceeded display the receipt page
@@ -124,24 +199,72 @@ func (app *application) PaymentSucceeded(w http.ResponseWriter, r *http.Request)
 		app.errorLog.Println(err)
 		return
 	}
-	//read posted data
-
-	widgetID, err := strconv.Atoi(r.Form.Get("product_id"))
-	if err != nil {
-		app.errorLog.Println(err)
-	}
 	txnData, err := app.GetTransactionData(r)
 	if err != nil {
 		app.errorLog.Println(err)
 		return
 	}
-	//create customer
-	customerId, err := app.SaveCustomer(txnData.FirstName, txnData.LastName, txnData.Email)
-	if err != nil {
+
+	// a refresh or re-post of this form must not record the payment twice
+	recorded, err := app.DB.GetOrderByPaymentIntent(txnData.PaymentIntentID)
+	if err == nil {
+		app.infoLog.Println("payment intent already recorded", txnData.PaymentIntentID)
+		txnData.Items = recorded.Items
+		app.Session.Put(r.Context(), "receipt", txnData)
+		http.Redirect(w, r, "/receipt", http.StatusSeeOther)
+		return
+	} else if !errors.Is(err, sql.ErrNoRows) {
 		app.errorLog.Println(err)
 		return
 	}
 
+	// make sure the customer paid the full price for what they ordered, at
+	// the prices fixed when the payment intent was made
+	if len(txnData.Items) == 0 {
+		app.errorLog.Printf("payment intent %s has no items", txnData.PaymentIntentID)
+		app.paymentProblem(w, r, txnData.PaymentIntentID)
+		return
+	}
+	expected := 0
+	units := 0
+	for i, item := range txnData.Items {
+		widget, err := app.DB.GetWidget(item.WidgetID)
+		if err != nil {
+			app.errorLog.Println(err)
+			app.paymentProblem(w, r, txnData.PaymentIntentID)
+			return
+		}
+		price := item.Price
+		if price == 0 {
+			// payment intents made before prices were fixed on them
+			var ok bool
+			price, ok = widget.PriceIn(txnData.PaymentCurrency)
+			if !ok {
+				app.errorLog.Printf("payment intent %s paid in %s, which widget %d is not sold in",
+					txnData.PaymentIntentID, txnData.PaymentCurrency, widget.ID)
+				app.paymentProblem(w, r, txnData.PaymentIntentID)
+				return
+			}
+		}
+		txnData.Items[i].Price = price
+		txnData.Items[i].Widget = widget
+		expected += price * item.Quantity
+		units += item.Quantity
+	}
+	expected += tax.Total(txnData.TaxLines) - txnData.Discount
+	if txnData.PaymentAmount != expected {
+		app.errorLog.Printf("payment intent %s paid %d, expected %d",
+			txnData.PaymentIntentID, txnData.PaymentAmount, expected)
+		app.paymentProblem(w, r, txnData.PaymentIntentID)
+		return
+	}
+	customer := models.Customer{
+		FirstName:        txnData.FirstName,
+		LastName:         txnData.LastName,
+		Email:            txnData.Email,
+		StripeCustomerID: txnData.StripeCustomerID,
+	}
+
 	txn := models.Transaction{
 		Amount:              txnData.PaymentAmount,
 		Currency:            txnData.PaymentCurrency,
@@ -152,41 +275,68 @@ func (app *application) PaymentSucceeded(w http.ResponseWriter, r *http.Request)
 		TransactionStatusID: 2,
 		PaymentIntent:       txnData.PaymentIntentID,
 		PaymentMethod:       txnData.PaymentMethodID,
-	}
-
-	txnId, err := app.SaveTransaction(txn)
-	if err != nil {
-		app.errorLog.Println(err)
-		return
+		CardBrand:           txnData.CardBrand,
+		CardSaved:           txnData.CardSaved,
 	}
 
 	// create order
-
 	order := models.Order{
-		WidgetID:      widgetID,
-		TransactionID: txnId,
-		CustomerID:    customerId,
-		StatusID:      1,
-		Quantity:      1,
-		Amount:        txnData.PaymentAmount,
-		CreatedAt:     time.Now(),
-		UpdatedAt:     time.Now(),
-	}
-	orderID, err := app.SaveOrders(order)
-	if err != nil {
+		WidgetID:  txnData.Items[0].WidgetID,
+		StatusID:  1,
+		Quantity:  units,
+		Amount:    txnData.PaymentAmount,
+		Discount:  txnData.Discount,
+		CouponID:  txnData.CouponID,
+		Tax:       tax.Total(txnData.TaxLines),
+		TaxState:  txnData.TaxState,
+		TaxLines:  txnData.TaxLines,
+		Items:     txnData.Items,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+
+	// customer, transaction, order and items are saved together or not at all
+	orderID, err := app.DB.CreateOrderWithPayment(customer, txn, order)
+	if errors.Is(err, models.ErrDuplicatePayment) {
+		// a concurrent post recorded it first
+		app.Session.Put(r.Context(), "receipt", txnData)
+		http.Redirect(w, r, "/receipt", http.StatusSeeOther)
+		return
+	} else if err != nil {
 		app.errorLog.Println(err)
+		app.paymentProblem(w, r, txnData.PaymentIntentID)
 		return
 	}
+	if r.Form.Get("from_cart") == "1" {
+		app.Session.Remove(r.Context(), "cart")
+	}
+	if txnData.CardSaved {
+		app.rememberSavedCard(r, txnData.PaymentMethodID)
+	}
+
 	//call micro service
 	inv := Invoice{
-		ID:        orderID,
-		Amount:    order.Amount,
-		Product:   "Widget",
-		Quantity:  order.Quantity,
-		FirstName: txnData.FirstName,
-		LastName:  txnData.LastName,
-		Email:     txnData.Email,
-		CreatedAt: time.Now(),
+		ID:          orderID,
+		Amount:      order.Amount,
+		Currency:    txnData.PaymentCurrency,
+		Product:     txnData.Items[0].Widget.Name,
+		Quantity:    order.Quantity,
+		FirstName:   txnData.FirstName,
+		LastName:    txnData.LastName,
+		Email:       txnData.Email,
+		CreatedAt:   time.Now(),
+		Discount:    txnData.Discount,
+		Coupon:      txnData.CouponCode,
+		TaxLines:    txnData.TaxLines,
+		TaxState:    txnData.TaxState,
+		SellerState: txnData.TaxSellerState,
+	}
+	for _, item := range txnData.Items {
+		inv.Items = append(inv.Items, InvoiceItem{
+			Product:  item.Widget.Name,
+			Quantity: item.Quantity,
+			Amount:   item.Total(),
+		})
 	}
 
 	err = app.callInvoiceMicro(inv)
@@ -200,6 +350,23 @@ func (app *application) PaymentSucceeded(w http.ResponseWriter, r *http.Request)
 	http.Redirect(w, r, "/receipt", http.StatusSeeOther)
 
 }
+
+// paymentProblem tells a customer whose card was charged that their order
+// could not be recorded, with the payment reference to quote to support
+func (app *application) paymentProblem(w http.ResponseWriter, r *http.Request, pi string) {
+	app.errorLog.Printf("payment intent %s was paid but no order was recorded", pi)
+
+	stringMap := make(map[string]string)
+	stringMap["payment-intent"] = pi
+
+	w.WriteHeader(http.StatusInternalServerError)
+	if err := app.renderTemplate(w, r, "payment-problem", &templateDate{
+		StringMap: stringMap,
+	}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
 func (app *application) callInvoiceMicro(inv Invoice) error {
 
 	url := "http://localhost:5000/invoice/create-and-send"
@@ -261,7 +428,11 @@ func (app *application) VirtualTerminalPaymentSucceeded(w http.ResponseWriter, r
 }
 
 func (app *application) Receipt(w http.ResponseWriter, r *http.Request) {
-	txn := app.Session.Get(r.Context(), "receipt").(TransactionData)
+	txn, ok := app.Session.Get(r.Context(), "receipt").(TransactionData)
+	if !ok {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
 	data := make(map[string]interface{})
 	data["txn"] = txn
 	app.Session.Remove(r.Context(), "receipt")
@@ -284,20 +455,6 @@ func (app *application) VirtualTerminalReceipt(w http.ResponseWriter, r *http.Re
 	}
 }
 
-//SaveCustomer saves a customer and returns a id
-func (app *application) SaveCustomer(firstName, lastName, email string) (int, error) {
-	cus := models.Customer{
-		FirstName: firstName,
-		LastName:  lastName,
-		Email:     email,
-	}
-	id, err := app.DB.InsertCustomer(cus)
-	if err != nil {
-		return 0, err
-	}
-	return id, nil
-}
-
 //SaveTransaction saves a transaction and returns a id
 func (app *application) SaveTransaction(transaction models.Transaction) (int, error) {
 
@@ -308,16 +465,6 @@ func (app *application) SaveTransaction(transaction models.Transaction) (int, er
 	return id, nil
 }
 
-//SaveOrders saves a order and returns a id
-func (app *application) SaveOrders(order models.Order) (int, error) {
-
-	id, err := app.DB.InsertOrder(order)
-	if err != nil {
-		return 0, err
-	}
-	return id, nil
-}
-
 // display the page to buy once
 func (app *application) ChargeOnce(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
@@ -332,9 +479,19 @@ func (app *application) ChargeOnce(w http.ResponseWriter, r *http.Request) {
 		app.errorLog.Println(err)
 		return
 	}
+	widget.Available, err = app.DB.GetAvailableStock(widget.ID)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+	if !widget.IsActive {
+		widget.Available = 0
+	}
 
 	data := make(map[string]interface{})
 	data["widget"] = widget
+	data["prices"] = widget.AllPrices()
+	data["saved-cards"] = app.savedCards(r)
 
 	if err := app.renderTemplate(w, r, "buy-once", &templateDate{
 		Data: data,
@@ -343,24 +500,52 @@ func (app *application) ChargeOnce(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-//BronzePlan displays the bronze paln page
-func (app *application) BronzePlan(w http.ResponseWriter, r *http.Request) {
-	widget, err := app.DB.GetWidget(2)
+//AllPlans displays the subscription plans on sale
+func (app *application) AllPlans(w http.ResponseWriter, r *http.Request) {
+	plans, err := app.DB.GetPlans()
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+	data := make(map[string]interface{})
+	data["plans"] = plans
+	if err := app.renderTemplate(w, r, "plans", &templateDate{
+		Data: data,
+	}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+//Plan displays the page to subscribe to one plan
+func (app *application) Plan(w http.ResponseWriter, r *http.Request) {
+	widgetID, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	widget, err := app.DB.GetWidget(widgetID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
 		app.errorLog.Println(err)
 		return
 	}
+	if !widget.IsRecurring || !widget.IsActive {
+		http.NotFound(w, r)
+		return
+	}
 	data := make(map[string]interface{})
 	data["widget"] = widget
-	if err := app.renderTemplate(w, r, "bronze-plan", &templateDate{
+	if err := app.renderTemplate(w, r, "plan", &templateDate{
 		Data: data,
 	}); err != nil {
 		app.errorLog.Println(err)
 	}
 }
 
-//BronzePlanReceipt displays the receipt for bronze plan
-func (app *application) BronzePlanReceipt(w http.ResponseWriter, r *http.Request) {
+//PlanReceipt displays the receipt for a subscription
+func (app *application) PlanReceipt(w http.ResponseWriter, r *http.Request) {
 
 	if err := app.renderTemplate(w, r, "receipt-plan", &templateDate{}); err != nil {
 		app.errorLog.Println(err)
@@ -473,6 +658,41 @@ func (app *application) OneUser(w http.ResponseWriter, r *http.Request) {
 
 }
 
+//AllWidgets shows the widget catalog
+func (app *application) AllWidgets(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "all-widgets", &templateDate{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+//OneWidget shows one widget for add/edit/retire
+func (app *application) OneWidget(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "one-widget", &templateDate{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+//Revenue shows the takings in each currency
+func (app *application) Revenue(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "revenue", &templateDate{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+//AllCoupons shows all coupons and how much they were used
+func (app *application) AllCoupons(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "all-coupons", &templateDate{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+//OneCoupon shows one coupon for add/edit, with its redemptions
+func (app *application) OneCoupon(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "one-coupon", &templateDate{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
 //AllSubscriptions display all subscriptions
 func (app *application) AllSubscriptions(w http.ResponseWriter, r *http.Request) {
 	if err := app.renderTemplate(w, r, "all-subscriptions", &templateDate{}); err != nil {
@@ -487,6 +707,7 @@ func (app *application) ShowSale(w http.ResponseWriter, r *http.Request) {
 	stringMap["refund-btn"] = "Refund Order"
 	stringMap["refunded-badge"] = "Refunded"
 	stringMap["refunded-msg"] = "Charge Refunded"
+	stringMap["partial-refunds"] = "1"
 	if err := app.renderTemplate(w, r, "sale", &templateDate{
 		StringMap: stringMap,
 	}); err != nil {
@@ -498,11 +719,23 @@ func (app *application) ShowSubscription(w http.ResponseWriter, r *http.Request)
 	stringMap["title"] = "Subscription"
 	stringMap["cancel"] = "/admin/all-subscriptions"
 	stringMap["refund-url"] = "/api/admin/cancel-subscription"
-	stringMap["refund-btn"] = "Cancel Subscription"
+	stringMap["refund-btn"] = "Cancel at Period End"
 	stringMap["refunded-badge"] = "Cancelled"
-	stringMap["refunded-msg"] = "Subscription Cancelled"
+	stringMap["refunded-msg"] = "Subscription will cancel at period end"
+	stringMap["change-plan"] = "1"
+	stringMap["subscription-actions"] = "1"
+
+	plans, err := app.DB.GetPlans()
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+	data := make(map[string]interface{})
+	data["plans"] = plans
+
 	if err := app.renderTemplate(w, r, "sale", &templateDate{
 		StringMap: stringMap,
+		Data:      data,
 	}); err != nil {
 		app.errorLog.Println(err)
 	}
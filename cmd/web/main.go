@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"html/template"
 	"log"
+	"myapp/internal/cards"
 	"myapp/internal/driver"
 	"myapp/internal/models"
 	"net/http"
@@ -31,6 +32,7 @@ type config struct {
 	stripe struct {
 		secret string
 		key    string
+		url    string
 	}
 	secretKey string
 	frontEnd  string
@@ -44,6 +46,7 @@ type application struct {
 	version       string
 	DB            models.DBModel
 	Session       *scs.SessionManager
+	Gateway       cards.PaymentGateway
 }
 
 func (app *application) serve() error {
@@ -61,6 +64,7 @@ func (app *application) serve() error {
 
 func main() {
 	gob.Register(TransactionData{})
+	gob.Register(Cart{})
 	var cfg config
 
 	flag.IntVar(&cfg.port, "port", 4000, "Server port to listen on")
@@ -69,6 +73,7 @@ func main() {
 	flag.StringVar(&cfg.db.dsn, "dsn", "girish:secret@tcp(localhost:3306)/widgets?parseTime=true&tls=false", "DSN")
 	flag.StringVar(&cfg.secretKey, "secret", "glhmfmfgjrtm23ouo6gu55kyedmglmng", "secret key")
 	flag.StringVar(&cfg.frontEnd, "frontend", "http://localhost:4000", "url to front end")
+	flag.StringVar(&cfg.stripe.url, "stripeurl", "", "override url for the stripe api")
 
 	flag.Parse()
 
@@ -100,6 +105,11 @@ func main() {
 		templateCache: tc,
 		DB:            models.DBModel{DB: conn},
 		Session:       session,
+		Gateway: &cards.Card{
+			Secret:  cfg.stripe.secret,
+			Key:     cfg.stripe.key,
+			BaseURL: cfg.stripe.url,
+		},
 	}
 
 	go app.ListenToWsChannel()
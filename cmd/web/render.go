@@ -4,6 +4,8 @@ import (
 	"embed"
 	"fmt"
 	"html/template"
+	"myapp/internal/money"
+	"myapp/internal/tax"
 	"net/http"
 	"strings"
 )
@@ -23,16 +25,24 @@ type templateDate struct {
 	CSSVersion           string
 	StripeSecretKey      string
 	StripePublishableKey string
+	// CustomerToken tells the API which customer is signed in
+	CustomerToken string
 }
 
 var functions = template.FuncMap{
 	"formatCurrency": formatCurrency,
+	"formatMoney":    formatMoney,
+	"gstStates":      tax.States,
 }
 
+// formatCurrency formats an amount in the minor unit of the currency widgets are priced in
 func formatCurrency(n int) string {
-	//f := float32(n / 100)
-	f := float32(n)
-	return fmt.Sprintf("₹%.2f", f)
+	return money.New(n, money.DefaultCurrency).String()
+}
+
+// formatMoney formats an amount in the minor unit of currency
+func formatMoney(n int, currency string) string {
+	return money.New(n, currency).String()
 }
 
 //go:embed templates
@@ -50,6 +60,9 @@ func (app *application) addDefaultData(td *templateDate, r *http.Request) *templ
 		td.IsAuthenticated = 0
 		td.UserID = 0
 	}
+	if email := app.Session.GetString(r.Context(), "customerEmail"); email != "" {
+		td.CustomerToken = app.customerToken(email)
+	}
 	return td
 }
 
@@ -17,22 +17,50 @@ func (app *application) routes() http.Handler {
 		mux.Use(app.Auth)
 
 		mux.Get("/virtual-terminal", app.VirtualTerminal)
+		mux.Get("/terminal-sales", app.TerminalSales)
+		mux.Get("/terminal-sales/{id}", app.TerminalSale)
 		mux.Get("/all-sales", app.AllSales)
 
 		mux.Get("/all-subscriptions", app.AllSubscriptions)
+		mux.Get("/revenue", app.Revenue)
 		mux.Get("/sales/{id}", app.ShowSale)
 		mux.Get("/subscription/{id}", app.ShowSubscription)
 
 		mux.Get("/all-users", app.AllUsers)
 		mux.Get("/all-users/{id}", app.OneUser)
+
+		mux.Get("/all-widgets", app.AllWidgets)
+		mux.Get("/all-widgets/{id}", app.OneWidget)
+		mux.Get("/all-coupons", app.AllCoupons)
+		mux.Get("/all-coupons/{id}", app.OneCoupon)
 	})
 
 	mux.Get("/widget/{id}", app.ChargeOnce)
 	mux.Post("/payment-succeeded", app.PaymentSucceeded)
 	mux.Get("/receipt", app.Receipt)
 
-	mux.Get("/plans/bronze", app.BronzePlan)
-	mux.Get("/receipt/bronze", app.BronzePlanReceipt)
+	mux.Get("/cart", app.ShowCart)
+	mux.Post("/cart/add", app.AddToCart)
+	mux.Post("/cart/update", app.UpdateCart)
+	mux.Post("/saved-cards/remove", app.RemoveSavedCard)
+
+	mux.Get("/account/login", app.CustomerLogin)
+	mux.Get("/account/verify", app.VerifyCustomerLogin)
+	mux.Get("/account/update-card", app.UpdateCardLink)
+	// also opened, without signing in, from a failed payment email
+	mux.Get("/account/subscriptions/{id}/card", app.SubscriptionCard)
+	mux.Route("/account", func(mux chi.Router) {
+		mux.Use(app.CustomerAuth)
+
+		mux.Get("/", app.Account)
+		mux.Get("/invoices/{id}", app.CustomerInvoice)
+		mux.Post("/subscriptions/{id}/cancel", app.CustomerCancelSubscription)
+		mux.Get("/logout", app.CustomerLogout)
+	})
+
+	mux.Get("/plans", app.AllPlans)
+	mux.Get("/plans/{id}", app.Plan)
+	mux.Get("/receipt/plan", app.PlanReceipt)
 
 	//auth routes
 	mux.Get("/login", app.LoginPage)
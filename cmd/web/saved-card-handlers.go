@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"myapp/internal/models"
+	"myapp/internal/urlsigner"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SavedCardOption is a saved card offered at checkout. Token is signed so the
+// API can tell that this browser saved the card.
+type SavedCardOption struct {
+	models.SavedCard
+	Token string
+}
+
+// sessionSavedCards returns the payment methods saved from this browser
+func (app *application) sessionSavedCards(r *http.Request) []string {
+	pms, _ := app.Session.Get(r.Context(), "saved_cards").([]string)
+	return pms
+}
+
+// rememberSavedCard lets this browser pay with a saved card again
+func (app *application) rememberSavedCard(r *http.Request, pm string) {
+	pms := app.sessionSavedCards(r)
+	for _, saved := range pms {
+		if saved == pm {
+			return
+		}
+	}
+	app.Session.Put(r.Context(), "saved_cards", append(pms, pm))
+	app.Session.Remove(r.Context(), "attached_cards_checked")
+}
+
+// attachedCardsTTL is how long the cards stripe reports as attached are
+// trusted before checkout asks stripe again
+const attachedCardsTTL = 10 * time.Minute
+
+// attachedCards returns the payment methods of saved that are still attached
+// in stripe. The answer is kept in the session for attachedCardsTTL, so that
+// every cart and buy page does not call stripe.
+func (app *application) attachedCards(r *http.Request, saved []models.SavedCard) map[string]bool {
+	attached := make(map[string]bool)
+
+	checked := app.Session.GetInt64(r.Context(), "attached_cards_checked")
+	if checked > 0 && time.Since(time.Unix(checked, 0)) < attachedCardsTTL {
+		pms, _ := app.Session.Get(r.Context(), "attached_cards").([]string)
+		for _, pm := range pms {
+			attached[pm] = true
+		}
+		return attached
+	}
+
+	listed := make(map[string]bool)
+	for _, card := range saved {
+		if card.StripeCustomerID == "" || listed[card.StripeCustomerID] {
+			continue
+		}
+		listed[card.StripeCustomerID] = true
+		methods, err := app.Gateway.ListPaymentMethods(card.StripeCustomerID)
+		if err != nil {
+			// not cached, so stripe is asked again next time
+			app.errorLog.Println(err)
+			return attached
+		}
+		for _, pm := range methods {
+			attached[pm.ID] = true
+		}
+	}
+
+	var pms []string
+	for pm := range attached {
+		pms = append(pms, pm)
+	}
+	app.Session.Put(r.Context(), "attached_cards", pms)
+	app.Session.Put(r.Context(), "attached_cards_checked", time.Now().Unix())
+	return attached
+}
+
+// savedCards returns the cards this browser can pay with, leaving out any
+// that are no longer attached in stripe
+func (app *application) savedCards(r *http.Request) []SavedCardOption {
+	var options []SavedCardOption
+
+	pms := app.sessionSavedCards(r)
+	if len(pms) == 0 {
+		return options
+	}
+	saved, err := app.DB.GetSavedCards(pms)
+	if err != nil {
+		app.errorLog.Println(err)
+		return options
+	}
+	attached := app.attachedCards(r, saved)
+
+	signer := urlsigner.Signer{
+		Secret: []byte(app.config.secretKey),
+	}
+	for _, card := range saved {
+		if !attached[card.PaymentMethod] {
+			continue
+		}
+		link := fmt.Sprintf("%s/saved-card?pm=%s", app.config.frontEnd, card.PaymentMethod)
+		options = append(options, SavedCardOption{
+			SavedCard: card,
+			Token:     signer.GenerateTokenFromString(link),
+		})
+	}
+	return options
+}
+
+// RemoveSavedCard detaches a card saved from this browser so it is not offered again
+func (app *application) RemoveSavedCard(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+	pm := r.Form.Get("payment_method")
+
+	back := r.Form.Get("back")
+	if !strings.HasPrefix(back, "/") || strings.HasPrefix(back, "//") {
+		back = "/cart"
+	}
+
+	// only cards saved from this browser can be removed from it
+	var kept []string
+	found := false
+	for _, saved := range app.sessionSavedCards(r) {
+		if saved == pm {
+			found = true
+			continue
+		}
+		kept = append(kept, saved)
+	}
+	if !found {
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	err = app.Gateway.DetachPaymentMethod(pm)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+	err = app.DB.ForgetSavedCard(pm)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+	app.Session.Put(r.Context(), "saved_cards", kept)
+	app.Session.Remove(r.Context(), "attached_cards_checked")
+
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
@@ -2,7 +2,10 @@ module myapp
 
 go 1.18
 
-require github.com/go-chi/cors v1.2.1
+require (
+	github.com/DATA-DOG/go-sqlmock v1.5.2
+	github.com/go-chi/cors v1.2.1
+)
 
 require (
 	github.com/alexedwards/scs/mssqlstore v0.0.0-20220528130143-d93ace5be94b // indirect
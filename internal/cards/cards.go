@@ -1,20 +1,56 @@
 package cards
 
 import (
+	"fmt"
 	"log"
+	"sync"
 
 	"github.com/stripe/stripe-go/v72"
-	"github.com/stripe/stripe-go/v72/customer"
-	"github.com/stripe/stripe-go/v72/paymentintent"
-	"github.com/stripe/stripe-go/v72/paymentmethod"
-	"github.com/stripe/stripe-go/v72/refund"
-	"github.com/stripe/stripe-go/v72/sub"
+	"github.com/stripe/stripe-go/v72/client"
 )
 
+// PaymentGateway is the set of card operations used by the handlers. Card
+// talks to Stripe; FakeGateway keeps everything in memory for tests.
+type PaymentGateway interface {
+	CreatePaymentIntent(currency string, amount int, metadata map[string]string) (*stripe.PaymentIntent, string, error)
+	AuthorizePaymentIntent(currency string, amount int, metadata map[string]string) (*stripe.PaymentIntent, string, error)
+	CapturePaymentIntent(id string, amount int) (*stripe.PaymentIntent, error)
+	RetrievePaymentIntent(id string) (*stripe.PaymentIntent, error)
+	CancelPaymentIntent(id string) error
+	GetPaymentMethod(s string) (*stripe.PaymentMethod, error)
+	CreateCustomer(pm, email string) (*stripe.Customer, string, error)
+	GetOrCreateCustomer(customerID, pm, email string) (*stripe.Customer, string, error)
+	ListPaymentMethods(customerID string) ([]*stripe.PaymentMethod, error)
+	AttachPaymentMethod(customerID, pm string) (string, error)
+	DetachPaymentMethod(pm string) error
+	SetDefaultPaymentMethod(customerID, pm string) (*stripe.Customer, error)
+	CreateCustomerPaymentIntent(customerID, currency string, amount int, metadata map[string]string) (*stripe.PaymentIntent, string, error)
+	ChargeSavedCard(pi, pm string) (*stripe.PaymentIntent, string, error)
+	SubscribeToPlan(cust *stripe.Customer, plan, email, last4, cardType string, trialDays int) (*stripe.Subscription, error)
+	GetSubscription(subId string) (*stripe.Subscription, error)
+	Refund(pi string, amount int, reason string) (*stripe.Refund, error)
+	CancelSubscription(subId string) error
+	CancelSubscriptionNow(subId string) (*stripe.Subscription, error)
+	PauseSubscription(subId string) error
+	ResumeSubscription(subId string) error
+	ChangePlan(subId, plan string, proration stripe.SubscriptionProrationBehavior) (*stripe.Subscription, error)
+	PayInvoice(invoiceID string) (*stripe.Invoice, error)
+	SetSubscriptionPaymentMethod(subId, pm string) error
+	WithIdempotencyKey(key string) PaymentGateway
+}
+
+// Card talks to Stripe with its own client, so several accounts can be used in
+// one process without touching the package-global stripe.Key.
 type Card struct {
 	Secret   string
 	Key      string
 	Currency string
+	// BaseURL overrides the Stripe API URL, e.g. to point at a local stand-in
+	BaseURL string
+
+	once           sync.Once
+	sc             *client.API
+	idempotencyKey string
 }
 
 type Transaction struct {
@@ -25,22 +61,78 @@ type Transaction struct {
 	BankReturnCode      string
 }
 
+// api returns the Stripe client for this card, creating it on first use
+func (c *Card) api() *client.API {
+	c.once.Do(func() {
+		var backends *stripe.Backends
+		if c.BaseURL != "" {
+			backends = &stripe.Backends{
+				API:     stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{URL: stripe.String(c.BaseURL)}),
+				Connect: stripe.GetBackendWithConfig(stripe.ConnectBackend, &stripe.BackendConfig{URL: stripe.String(c.BaseURL)}),
+				Uploads: stripe.GetBackendWithConfig(stripe.UploadsBackend, &stripe.BackendConfig{URL: stripe.String(c.BaseURL)}),
+			}
+		}
+		c.sc = client.New(c.Secret, backends)
+	})
+	return c.sc
+}
+
+// WithIdempotencyKey returns a card sharing this card's client whose stripe
+// calls carry keys derived from key, so retrying a request is safe
+func (c *Card) WithIdempotencyKey(key string) PaymentGateway {
+	keyed := &Card{
+		Secret:         c.Secret,
+		Key:            c.Key,
+		Currency:       c.Currency,
+		BaseURL:        c.BaseURL,
+		sc:             c.api(),
+		idempotencyKey: key,
+	}
+	keyed.once.Do(func() {})
+	return keyed
+}
+
+// setIdempotencyKey derives a key for one stripe operation, since a single
+// request may make several different stripe calls
+func (c *Card) setIdempotencyKey(p *stripe.Params, operation string) {
+	if c.idempotencyKey != "" {
+		p.SetIdempotencyKey(c.idempotencyKey + "-" + operation)
+	}
+}
+
 func (c *Card) Charge(currency string, amount int) (*stripe.PaymentIntent, string, error) {
-	return c.CreatePaymentIntent(currency, amount)
+	return c.CreatePaymentIntent(currency, amount, nil)
 }
 
-func (c *Card) CreatePaymentIntent(currency string, amount int) (*stripe.PaymentIntent, string, error) {
-	stripe.Key = c.Secret
+func (c *Card) CreatePaymentIntent(currency string, amount int, metadata map[string]string) (*stripe.PaymentIntent, string, error) {
+	return c.createPaymentIntent(currency, amount, metadata, false)
+}
 
+// AuthorizePaymentIntent creates a payment intent that only places a hold on
+// the card when it is confirmed. The hold is taken with CapturePaymentIntent
+// or released with CancelPaymentIntent.
+func (c *Card) AuthorizePaymentIntent(currency string, amount int, metadata map[string]string) (*stripe.PaymentIntent, string, error) {
+	return c.createPaymentIntent(currency, amount, metadata, true)
+}
+
+func (c *Card) createPaymentIntent(currency string, amount int, metadata map[string]string, manualCapture bool) (*stripe.PaymentIntent, string, error) {
 	// create a payment intent
 	params := &stripe.PaymentIntentParams{
 		Amount:   stripe.Int64(int64(amount)),
 		Currency: stripe.String(currency),
 	}
+	operation := "payment-intent"
+	if manualCapture {
+		params.CaptureMethod = stripe.String(string(stripe.PaymentIntentCaptureMethodManual))
+		operation = "authorization"
+	}
 
-	//params.AddMetadata("key", "value")
+	for k, v := range metadata {
+		params.AddMetadata(k, v)
+	}
 
-	pi, err := paymentintent.New(params)
+	c.setIdempotencyKey(&params.Params, operation)
+	pi, err := c.api().PaymentIntents.New(params)
 	if err != nil {
 		msg := ""
 		if stripeErr, ok := err.(*stripe.Error); ok {
@@ -53,9 +145,7 @@ func (c *Card) CreatePaymentIntent(currency string, amount int) (*stripe.Payment
 
 //GetPaymentMethod gets the payment method by payment intent id
 func (c *Card) GetPaymentMethod(s string) (*stripe.PaymentMethod, error) {
-	stripe.Key = c.Secret
-
-	pm, err := paymentmethod.Get(s, nil)
+	pm, err := c.api().PaymentMethods.Get(s, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -64,17 +154,42 @@ func (c *Card) GetPaymentMethod(s string) (*stripe.PaymentMethod, error) {
 
 // RetrievePaymentIntent gets an existing payment intent by id
 func (c *Card) RetrievePaymentIntent(id string) (*stripe.PaymentIntent, error) {
-	stripe.Key = c.Secret
+	pi, err := c.api().PaymentIntents.Get(id, nil)
+	if err != nil {
+		return nil, err
+	}
+	return pi, nil
+}
 
-	pi, err := paymentintent.Get(id, nil)
+// CapturePaymentIntent takes amount of the hold placed by an authorized
+// payment intent. The rest of the hold is released.
+func (c *Card) CapturePaymentIntent(id string, amount int) (*stripe.PaymentIntent, error) {
+	params := &stripe.PaymentIntentCaptureParams{
+		AmountToCapture: stripe.Int64(int64(amount)),
+	}
+	c.setIdempotencyKey(&params.Params, "capture")
+	pi, err := c.api().PaymentIntents.Capture(id, params)
 	if err != nil {
 		return nil, err
 	}
 	return pi, nil
 }
 
-//subscripe to plan to customer in stripe
-func (c *Card) SubscribeToPlan(cust *stripe.Customer, plan, email, last4, cardType string) (*stripe.Subscription, error) {
+// CancelPaymentIntent cancels a payment intent that has not been paid, which
+// also voids the hold of an authorized one
+func (c *Card) CancelPaymentIntent(id string) error {
+	params := &stripe.PaymentIntentCancelParams{}
+	c.setIdempotencyKey(&params.Params, "cancel-payment-intent")
+	_, err := c.api().PaymentIntents.Cancel(id, params)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+//subscripe to plan to customer in stripe. With trialDays > 0 the first
+//invoice is only charged when the trial ends.
+func (c *Card) SubscribeToPlan(cust *stripe.Customer, plan, email, last4, cardType string, trialDays int) (*stripe.Subscription, error) {
 	stripeCustomerId := cust.ID
 	items := []*stripe.SubscriptionItemsParams{
 		{Plan: stripe.String(plan)},
@@ -85,9 +200,13 @@ func (c *Card) SubscribeToPlan(cust *stripe.Customer, plan, email, last4, cardTy
 	}
 	params.AddMetadata("last_four", last4)
 	params.AddMetadata("card_type", cardType)
+	if trialDays > 0 {
+		params.TrialPeriodDays = stripe.Int64(int64(trialDays))
+	}
 
 	params.AddExpand("latest_invoice.payment_intent")
-	subscription, err := sub.New(params)
+	c.setIdempotencyKey(&params.Params, "subscription")
+	subscription, err := c.api().Subscriptions.New(params)
 
 	if err != nil {
 		log.Println(err)
@@ -96,9 +215,20 @@ func (c *Card) SubscribeToPlan(cust *stripe.Customer, plan, email, last4, cardTy
 	return subscription, nil
 }
 
+//GetSubscription gets a subscription with its customer, latest invoice and payment intent
+func (c *Card) GetSubscription(subId string) (*stripe.Subscription, error) {
+	params := &stripe.SubscriptionParams{}
+	params.AddExpand("latest_invoice.payment_intent")
+	params.AddExpand("customer")
+	subscription, err := c.api().Subscriptions.Get(subId, params)
+	if err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
+
 //CreateCustomer create customer in stripe
 func (c *Card) CreateCustomer(pm, email string) (*stripe.Customer, string, error) {
-	stripe.Key = c.Secret
 	customerParams := &stripe.CustomerParams{
 		PaymentMethod: stripe.String(pm),
 		Email:         stripe.String(email),
@@ -106,7 +236,8 @@ func (c *Card) CreateCustomer(pm, email string) (*stripe.Customer, string, error
 			DefaultPaymentMethod: stripe.String(pm),
 		},
 	}
-	cust, err := customer.New(customerParams)
+	c.setIdempotencyKey(&customerParams.Params, "customer")
+	cust, err := c.api().Customers.New(customerParams)
 	if err != nil {
 		msg := ""
 		if stripeErr, ok := err.(*stripe.Error); ok {
@@ -116,35 +247,160 @@ func (c *Card) CreateCustomer(pm, email string) (*stripe.Customer, string, error
 	}
 	return cust, "", nil
 }
-func (c *Card) Refund(pi string, amount int) error {
-	stripe.Key = c.Secret
 
+// GetOrCreateCustomer returns the stripe customer with customerID, with pm
+// attached as the default payment method, or a new customer when customerID
+// is empty. Customers are never looked up by email, as anyone can type one.
+// With no pm the customer is returned as it is.
+func (c *Card) GetOrCreateCustomer(customerID, pm, email string) (*stripe.Customer, string, error) {
+	if customerID == "" && pm == "" {
+		params := &stripe.CustomerParams{Email: stripe.String(email)}
+		c.setIdempotencyKey(&params.Params, "customer")
+		cust, err := c.api().Customers.New(params)
+		if err != nil {
+			return nil, "", err
+		}
+		return cust, "", nil
+	}
+	if customerID == "" {
+		return c.CreateCustomer(pm, email)
+	}
+	if pm == "" {
+		cust, err := c.api().Customers.Get(customerID, nil)
+		if err != nil {
+			return nil, "", err
+		}
+		return cust, "", nil
+	}
+
+	msg, err := c.AttachPaymentMethod(customerID, pm)
+	if err != nil {
+		return nil, msg, err
+	}
+	cust, err := c.SetDefaultPaymentMethod(customerID, pm)
+	if err != nil {
+		return nil, "", err
+	}
+	return cust, "", nil
+}
+
+// Refund refunds amount of a payment intent. It may be called several times
+// for partial refunds, up to the amount captured.
+func (c *Card) Refund(pi string, amount int, reason string) (*stripe.Refund, error) {
 	amountToRefund := int64(amount)
 	refundParams := &stripe.RefundParams{
 		Amount:        &amountToRefund,
 		PaymentIntent: &pi,
 	}
-	_, err := refund.New(refundParams)
+	if reason != "" {
+		refundParams.AddMetadata("reason", reason)
+	}
+	c.setIdempotencyKey(&refundParams.Params, "refund")
+	rf, err := c.api().Refunds.New(refundParams)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	return rf, nil
 }
 
+// CancelSubscription cancels a subscription at the end of the period the
+// customer has paid for
 func (c *Card) CancelSubscription(subId string) error {
 
-	stripe.Key = c.Secret
-
 	params := &stripe.SubscriptionParams{
 		CancelAtPeriodEnd: stripe.Bool(true),
 	}
 
-	_, err := sub.Update(subId, params)
+	c.setIdempotencyKey(&params.Params, "cancel-subscription")
+	_, err := c.api().Subscriptions.Update(subId, params)
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+// CancelSubscriptionNow cancels a subscription straight away. The returned
+// subscription has its latest invoice and payment intent expanded, so the
+// caller can refund the unused part of the period.
+func (c *Card) CancelSubscriptionNow(subId string) (*stripe.Subscription, error) {
+	params := &stripe.SubscriptionCancelParams{}
+	params.AddExpand("latest_invoice.payment_intent")
+	c.setIdempotencyKey(&params.Params, "cancel-subscription-now")
+	subscription, err := c.api().Subscriptions.Cancel(subId, params)
+	if err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
+
+// PauseSubscription stops collecting payments for a subscription; invoices
+// raised while paused are voided
+func (c *Card) PauseSubscription(subId string) error {
+	params := &stripe.SubscriptionParams{
+		PauseCollection: &stripe.SubscriptionPauseCollectionParams{
+			Behavior: stripe.String(string(stripe.SubscriptionPauseCollectionBehaviorVoid)),
+		},
+	}
+	c.setIdempotencyKey(&params.Params, "pause-subscription")
+	_, err := c.api().Subscriptions.Update(subId, params)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ResumeSubscription undoes a pause or a pending cancellation
+func (c *Card) ResumeSubscription(subId string) error {
+	params := &stripe.SubscriptionParams{
+		CancelAtPeriodEnd: stripe.Bool(false),
+	}
+	// an empty pause_collection clears it
+	params.AddExtra("pause_collection", "")
+	c.setIdempotencyKey(&params.Params, "resume-subscription")
+	_, err := c.api().Subscriptions.Update(subId, params)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ChangePlan moves a subscription to another plan. proration decides whether
+// the customer is credited or charged for the rest of the current period.
+func (c *Card) ChangePlan(subId, plan string, proration stripe.SubscriptionProrationBehavior) (*stripe.Subscription, error) {
+	subscription, err := c.api().Subscriptions.Get(subId, nil)
+	if err != nil {
+		return nil, err
+	}
+	if subscription.Items == nil || len(subscription.Items.Data) == 0 {
+		return nil, fmt.Errorf("subscription %s has no items", subId)
+	}
+
+	params := &stripe.SubscriptionParams{
+		Items: []*stripe.SubscriptionItemsParams{
+			{
+				ID:    stripe.String(subscription.Items.Data[0].ID),
+				Price: stripe.String(plan),
+			},
+		},
+		ProrationBehavior: stripe.String(string(proration)),
+	}
+	c.setIdempotencyKey(&params.Params, "change-plan")
+	subscription, err = c.api().Subscriptions.Update(subId, params)
+	if err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
+
+// ChargeID returns the id of the latest charge of a payment intent, or "" when
+// nothing has been charged yet
+func ChargeID(pi *stripe.PaymentIntent) string {
+	if pi.Charges == nil || len(pi.Charges.Data) == 0 {
+		return ""
+	}
+	return pi.Charges.Data[0].ID
+}
+
 func cardErrorMessage(code stripe.ErrorCode) string {
 	var msg = ""
 	switch code {
@@ -0,0 +1,674 @@
+package cards
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// FakeOutcome scripts the result of one call on a FakeGateway
+type FakeOutcome struct {
+	DeclineCode   stripe.ErrorCode
+	RequireAction bool
+}
+
+// FakeGateway is an in-memory PaymentGateway for tests. Every call that
+// touches a card takes the next scripted outcome; when nothing is scripted
+// the call succeeds. As with stripe, a new payment intent is not paid until
+// it is confirmed, by Confirm for the customer's browser or by ChargeSavedCard.
+type FakeGateway struct {
+	mu       sync.Mutex
+	outcomes []FakeOutcome
+	seq      int
+
+	PaymentIntents map[string]*stripe.PaymentIntent
+	PaymentMethods map[string]*stripe.PaymentMethod
+	Customers      map[string]*stripe.Customer
+	Subscriptions  map[string]*stripe.Subscription
+	Refunds        []*stripe.Refund
+	// IdempotencyKeys lists every key passed to WithIdempotencyKey
+	IdempotencyKeys []string
+}
+
+// NewFakeGateway returns an empty fake gateway
+func NewFakeGateway() *FakeGateway {
+	return &FakeGateway{
+		PaymentIntents: make(map[string]*stripe.PaymentIntent),
+		PaymentMethods: make(map[string]*stripe.PaymentMethod),
+		Customers:      make(map[string]*stripe.Customer),
+		Subscriptions:  make(map[string]*stripe.Subscription),
+	}
+}
+
+// Succeed scripts the next call to succeed
+func (f *FakeGateway) Succeed() {
+	f.script(FakeOutcome{})
+}
+
+// Decline scripts the next call to fail with the given stripe error code
+func (f *FakeGateway) Decline(code stripe.ErrorCode) {
+	f.script(FakeOutcome{DeclineCode: code})
+}
+
+// RequireAction scripts the next call to leave its payment intent in requires_action
+func (f *FakeGateway) RequireAction() {
+	f.script(FakeOutcome{RequireAction: true})
+}
+
+// CompleteAction finishes the customer authentication of a payment intent
+// left in requires_action, and activates the subscription it belongs to
+func (f *FakeGateway) CompleteAction(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pi, ok := f.PaymentIntents[id]
+	if !ok || pi.Status != stripe.PaymentIntentStatusRequiresAction {
+		return
+	}
+	pi.NextAction = nil
+	f.charge(pi)
+	for _, subscription := range f.Subscriptions {
+		if subscription.LatestInvoice != nil && subscription.LatestInvoice.PaymentIntent == pi {
+			subscription.Status = stripe.SubscriptionStatusActive
+		}
+	}
+}
+
+// AddCard registers a card payment method that GetPaymentMethod will return
+func (f *FakeGateway) AddCard(id string, brand stripe.PaymentMethodCardBrand, last4 string, expMonth, expYear int) *stripe.PaymentMethod {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pm := &stripe.PaymentMethod{
+		ID:   id,
+		Type: stripe.PaymentMethodTypeCard,
+		Card: &stripe.PaymentMethodCard{
+			Brand:    brand,
+			Last4:    last4,
+			ExpMonth: uint64(expMonth),
+			ExpYear:  uint64(expYear),
+		},
+	}
+	f.PaymentMethods[id] = pm
+	return pm
+}
+
+func (f *FakeGateway) script(o FakeOutcome) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.outcomes = append(f.outcomes, o)
+}
+
+// next pops the next scripted outcome. Callers must hold f.mu.
+func (f *FakeGateway) next() FakeOutcome {
+	if len(f.outcomes) == 0 {
+		return FakeOutcome{}
+	}
+	o := f.outcomes[0]
+	f.outcomes = f.outcomes[1:]
+	return o
+}
+
+// newID returns a unique stripe-like id. Callers must hold f.mu.
+func (f *FakeGateway) newID(prefix string) string {
+	f.seq++
+	return fmt.Sprintf("%s_fake%d", prefix, f.seq)
+}
+
+func fakeCardError(code stripe.ErrorCode) *stripe.Error {
+	return &stripe.Error{
+		Code:           code,
+		Type:           stripe.ErrorTypeCard,
+		Msg:            cardErrorMessage(code),
+		HTTPStatusCode: http.StatusPaymentRequired,
+	}
+}
+
+func fakeNotFound(id string) *stripe.Error {
+	return &stripe.Error{
+		Code:           stripe.ErrorCodeResourceMissing,
+		Type:           stripe.ErrorTypeInvalidRequest,
+		Msg:            fmt.Sprintf("No such object: '%s'", id),
+		HTTPStatusCode: http.StatusNotFound,
+	}
+}
+
+// newPaymentIntent builds a payment intent that has not been confirmed yet. Callers must hold f.mu.
+func (f *FakeGateway) newPaymentIntent(currency string, amount int, metadata map[string]string) *stripe.PaymentIntent {
+	id := f.newID("pi")
+	pi := &stripe.PaymentIntent{
+		ID:           id,
+		Amount:       int64(amount),
+		Currency:     currency,
+		Metadata:     metadata,
+		ClientSecret: id + "_secret_fake",
+		Status:       stripe.PaymentIntentStatusRequiresPaymentMethod,
+		Charges:      &stripe.ChargeList{},
+	}
+	f.PaymentIntents[id] = pi
+	return pi
+}
+
+// settle charges the card of a new payment intent, or leaves it waiting for
+// authentication when o says so. Callers must hold f.mu.
+func (f *FakeGateway) settle(pi *stripe.PaymentIntent, o FakeOutcome) {
+	if o.RequireAction {
+		pi.Status = stripe.PaymentIntentStatusRequiresAction
+		pi.NextAction = &stripe.PaymentIntentNextAction{Type: "use_stripe_sdk"}
+		return
+	}
+	f.charge(pi)
+}
+
+// charge charges the card of a confirmed payment intent, or only places a
+// hold on it for manual capture. Callers must hold f.mu.
+func (f *FakeGateway) charge(pi *stripe.PaymentIntent) {
+	captured := pi.CaptureMethod != stripe.PaymentIntentCaptureMethodManual
+	pi.Charges.Data = []*stripe.Charge{{
+		ID:       f.newID("ch"),
+		Amount:   pi.Amount,
+		Currency: stripe.Currency(pi.Currency),
+		Paid:     true,
+		Captured: captured,
+	}}
+	if captured {
+		pi.Status = stripe.PaymentIntentStatusSucceeded
+		pi.AmountReceived = pi.Amount
+		pi.Charges.Data[0].AmountCaptured = pi.Amount
+	} else {
+		pi.Status = stripe.PaymentIntentStatusRequiresCapture
+		pi.AmountCapturable = pi.Amount
+	}
+}
+
+func (f *FakeGateway) CreatePaymentIntent(currency string, amount int, metadata map[string]string) (*stripe.PaymentIntent, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pi := f.newPaymentIntent(currency, amount, metadata)
+	return pi, "", nil
+}
+
+func (f *FakeGateway) AuthorizePaymentIntent(currency string, amount int, metadata map[string]string) (*stripe.PaymentIntent, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pi := f.newPaymentIntent(currency, amount, metadata)
+	pi.CaptureMethod = stripe.PaymentIntentCaptureMethodManual
+	return pi, "", nil
+}
+
+// Confirm pays a payment intent the way stripe.js does in the customer's
+// browser, with the next scripted outcome. A declined card leaves the payment
+// intent waiting for another payment method.
+func (f *FakeGateway) Confirm(id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pi, ok := f.PaymentIntents[id]
+	if !ok {
+		return fakeNotFound(id)
+	}
+	if pi.Status != stripe.PaymentIntentStatusRequiresPaymentMethod {
+		return &stripe.Error{
+			Code:           stripe.ErrorCodePaymentIntentUnexpectedState,
+			Type:           stripe.ErrorTypeInvalidRequest,
+			Msg:            fmt.Sprintf("This PaymentIntent's status is %s, so it can not be confirmed", pi.Status),
+			HTTPStatusCode: http.StatusBadRequest,
+		}
+	}
+
+	o := f.next()
+	if o.DeclineCode != "" {
+		pi.LastPaymentError = fakeCardError(o.DeclineCode)
+		return pi.LastPaymentError
+	}
+	pi.LastPaymentError = nil
+	f.settle(pi, o)
+	return nil
+}
+
+func (f *FakeGateway) CapturePaymentIntent(id string, amount int) (*stripe.PaymentIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	o := f.next()
+	if o.DeclineCode != "" {
+		return nil, fakeCardError(o.DeclineCode)
+	}
+	pi, ok := f.PaymentIntents[id]
+	if !ok {
+		return nil, fakeNotFound(id)
+	}
+	if pi.Status != stripe.PaymentIntentStatusRequiresCapture || int64(amount) > pi.AmountCapturable {
+		return nil, &stripe.Error{
+			Code:           stripe.ErrorCodeAmountTooLarge,
+			Type:           stripe.ErrorTypeInvalidRequest,
+			Msg:            "This PaymentIntent could not be captured for that amount",
+			HTTPStatusCode: http.StatusBadRequest,
+		}
+	}
+	pi.Status = stripe.PaymentIntentStatusSucceeded
+	pi.AmountReceived = int64(amount)
+	pi.AmountCapturable = 0
+	pi.Charges.Data[0].Captured = true
+	pi.Charges.Data[0].AmountCaptured = int64(amount)
+	return pi, nil
+}
+
+func (f *FakeGateway) RetrievePaymentIntent(id string) (*stripe.PaymentIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pi, ok := f.PaymentIntents[id]
+	if !ok {
+		return nil, fakeNotFound(id)
+	}
+	return pi, nil
+}
+
+func (f *FakeGateway) CancelPaymentIntent(id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pi, ok := f.PaymentIntents[id]
+	if !ok {
+		return fakeNotFound(id)
+	}
+	pi.Status = stripe.PaymentIntentStatusCanceled
+	pi.AmountCapturable = 0
+	return nil
+}
+
+func (f *FakeGateway) GetPaymentMethod(s string) (*stripe.PaymentMethod, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pm, ok := f.PaymentMethods[s]
+	if !ok {
+		return nil, fakeNotFound(s)
+	}
+	return pm, nil
+}
+
+func (f *FakeGateway) CreateCustomer(pm, email string) (*stripe.Customer, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	o := f.next()
+	if o.DeclineCode != "" {
+		return nil, cardErrorMessage(o.DeclineCode), fakeCardError(o.DeclineCode)
+	}
+	cust := &stripe.Customer{
+		ID:              f.newID("cus"),
+		Email:           email,
+		InvoiceSettings: &stripe.CustomerInvoiceSettings{},
+	}
+	if method, ok := f.PaymentMethods[pm]; ok {
+		method.Customer = cust
+	}
+	if pm != "" {
+		cust.InvoiceSettings.DefaultPaymentMethod = &stripe.PaymentMethod{ID: pm}
+	}
+	f.Customers[cust.ID] = cust
+	return cust, "", nil
+}
+
+func (f *FakeGateway) GetOrCreateCustomer(customerID, pm, email string) (*stripe.Customer, string, error) {
+	if customerID == "" {
+		return f.CreateCustomer(pm, email)
+	}
+	f.mu.Lock()
+	cust, ok := f.Customers[customerID]
+	f.mu.Unlock()
+	if !ok {
+		return nil, "", fakeNotFound(customerID)
+	}
+	if pm == "" {
+		return cust, "", nil
+	}
+
+	msg, err := f.AttachPaymentMethod(cust.ID, pm)
+	if err != nil {
+		return nil, msg, err
+	}
+	cust, err = f.SetDefaultPaymentMethod(cust.ID, pm)
+	if err != nil {
+		return nil, "", err
+	}
+	return cust, "", nil
+}
+
+func (f *FakeGateway) ListPaymentMethods(customerID string) ([]*stripe.PaymentMethod, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var methods []*stripe.PaymentMethod
+	for _, pm := range f.PaymentMethods {
+		if pm.Customer != nil && pm.Customer.ID == customerID {
+			methods = append(methods, pm)
+		}
+	}
+	return methods, nil
+}
+
+func (f *FakeGateway) AttachPaymentMethod(customerID, pm string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	o := f.next()
+	if o.DeclineCode != "" {
+		return cardErrorMessage(o.DeclineCode), fakeCardError(o.DeclineCode)
+	}
+	cust, ok := f.Customers[customerID]
+	if !ok {
+		return "", fakeNotFound(customerID)
+	}
+	method, ok := f.PaymentMethods[pm]
+	if !ok {
+		return "", fakeNotFound(pm)
+	}
+	method.Customer = cust
+	return "", nil
+}
+
+func (f *FakeGateway) DetachPaymentMethod(pm string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	method, ok := f.PaymentMethods[pm]
+	if !ok {
+		return fakeNotFound(pm)
+	}
+	method.Customer = nil
+	return nil
+}
+
+func (f *FakeGateway) SetDefaultPaymentMethod(customerID, pm string) (*stripe.Customer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cust, ok := f.Customers[customerID]
+	if !ok {
+		return nil, fakeNotFound(customerID)
+	}
+	cust.InvoiceSettings = &stripe.CustomerInvoiceSettings{
+		DefaultPaymentMethod: &stripe.PaymentMethod{ID: pm},
+	}
+	return cust, nil
+}
+
+func (f *FakeGateway) CreateCustomerPaymentIntent(customerID, currency string, amount int, metadata map[string]string) (*stripe.PaymentIntent, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cust, ok := f.Customers[customerID]
+	if !ok {
+		return nil, "", fakeNotFound(customerID)
+	}
+	pi := f.newPaymentIntent(currency, amount, metadata)
+	pi.Customer = cust
+	pi.SetupFutureUsage = stripe.PaymentIntentSetupFutureUsageOffSession
+	return pi, "", nil
+}
+
+func (f *FakeGateway) ChargeSavedCard(pi, pm string) (*stripe.PaymentIntent, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	o := f.next()
+	if o.DeclineCode != "" {
+		return nil, cardErrorMessage(o.DeclineCode), fakeCardError(o.DeclineCode)
+	}
+	intent, ok := f.PaymentIntents[pi]
+	if !ok {
+		return nil, "", fakeNotFound(pi)
+	}
+	method, ok := f.PaymentMethods[pm]
+	if !ok || method.Customer == nil || intent.Customer == nil || method.Customer.ID != intent.Customer.ID {
+		return nil, "", fakeNotFound(pm)
+	}
+	intent.PaymentMethod = method
+	if o.RequireAction {
+		intent.Status = stripe.PaymentIntentStatusRequiresPaymentMethod
+		return intent, "Your bank needs you to confirm this payment", &stripe.Error{
+			HTTPStatusCode: http.StatusPaymentRequired,
+			Type:           stripe.ErrorTypeCard,
+			Code:           stripe.ErrorCodeAuthenticationRequired,
+			PaymentIntent:  intent,
+		}
+	}
+	f.charge(intent)
+	return intent, "", nil
+}
+
+func (f *FakeGateway) SubscribeToPlan(cust *stripe.Customer, plan, email, last4, cardType string, trialDays int) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	o := f.next()
+	if o.DeclineCode != "" {
+		return nil, fakeCardError(o.DeclineCode)
+	}
+	if _, ok := f.Customers[cust.ID]; !ok {
+		return nil, fakeNotFound(cust.ID)
+	}
+
+	pi := f.newPaymentIntent("inr", 0, nil)
+	f.settle(pi, o)
+	now := time.Now()
+	subscription := &stripe.Subscription{
+		ID:                 f.newID("sub"),
+		Customer:           cust,
+		Status:             stripe.SubscriptionStatusActive,
+		CurrentPeriodStart: now.Unix(),
+		CurrentPeriodEnd:   now.AddDate(0, 1, 0).Unix(),
+		Items: &stripe.SubscriptionItemList{
+			Data: []*stripe.SubscriptionItem{{
+				ID:    f.newID("si"),
+				Price: &stripe.Price{ID: plan},
+			}},
+		},
+		LatestInvoice: &stripe.Invoice{
+			ID:            f.newID("in"),
+			PaymentIntent: pi,
+		},
+		Metadata: map[string]string{
+			"last_four": last4,
+			"card_type": cardType,
+		},
+	}
+	if trialDays > 0 {
+		// nothing is charged until the trial ends
+		subscription.Status = stripe.SubscriptionStatusTrialing
+		subscription.TrialStart = now.Unix()
+		subscription.TrialEnd = now.AddDate(0, 0, trialDays).Unix()
+		subscription.CurrentPeriodEnd = subscription.TrialEnd
+		subscription.LatestInvoice.PaymentIntent = nil
+	} else if o.RequireAction {
+		subscription.Status = stripe.SubscriptionStatusIncomplete
+	}
+	f.Subscriptions[subscription.ID] = subscription
+	return subscription, nil
+}
+
+func (f *FakeGateway) GetSubscription(subId string) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	subscription, ok := f.Subscriptions[subId]
+	if !ok {
+		return nil, fakeNotFound(subId)
+	}
+	return subscription, nil
+}
+
+func (f *FakeGateway) Refund(pi string, amount int, reason string) (*stripe.Refund, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	o := f.next()
+	if o.DeclineCode != "" {
+		return nil, fakeCardError(o.DeclineCode)
+	}
+	intent, ok := f.PaymentIntents[pi]
+	if !ok {
+		return nil, fakeNotFound(pi)
+	}
+
+	refunded := 0
+	for _, x := range f.Refunds {
+		if x.PaymentIntent != nil && x.PaymentIntent.ID == pi {
+			refunded += int(x.Amount)
+		}
+	}
+	if refunded+amount > int(intent.AmountReceived) {
+		return nil, &stripe.Error{
+			Code:           stripe.ErrorCodeAmountTooLarge,
+			Type:           stripe.ErrorTypeInvalidRequest,
+			Msg:            "Refund amount is greater than the unrefunded amount on the charge",
+			HTTPStatusCode: http.StatusBadRequest,
+		}
+	}
+
+	rf := &stripe.Refund{
+		ID:            f.newID("re"),
+		Amount:        int64(amount),
+		Currency:      stripe.Currency(intent.Currency),
+		PaymentIntent: intent,
+		Status:        stripe.RefundStatusSucceeded,
+		Metadata:      map[string]string{"reason": reason},
+	}
+	f.Refunds = append(f.Refunds, rf)
+	return rf, nil
+}
+
+func (f *FakeGateway) CancelSubscription(subId string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	o := f.next()
+	if o.DeclineCode != "" {
+		return fakeCardError(o.DeclineCode)
+	}
+	subscription, ok := f.Subscriptions[subId]
+	if !ok {
+		return fakeNotFound(subId)
+	}
+	subscription.CancelAtPeriodEnd = true
+	return nil
+}
+
+func (f *FakeGateway) CancelSubscriptionNow(subId string) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	o := f.next()
+	if o.DeclineCode != "" {
+		return nil, fakeCardError(o.DeclineCode)
+	}
+	subscription, ok := f.Subscriptions[subId]
+	if !ok {
+		return nil, fakeNotFound(subId)
+	}
+	subscription.Status = stripe.SubscriptionStatusCanceled
+	return subscription, nil
+}
+
+func (f *FakeGateway) PauseSubscription(subId string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	o := f.next()
+	if o.DeclineCode != "" {
+		return fakeCardError(o.DeclineCode)
+	}
+	subscription, ok := f.Subscriptions[subId]
+	if !ok {
+		return fakeNotFound(subId)
+	}
+	subscription.PauseCollection.Behavior = stripe.SubscriptionPauseCollectionBehaviorVoid
+	return nil
+}
+
+func (f *FakeGateway) ResumeSubscription(subId string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	o := f.next()
+	if o.DeclineCode != "" {
+		return fakeCardError(o.DeclineCode)
+	}
+	subscription, ok := f.Subscriptions[subId]
+	if !ok {
+		return fakeNotFound(subId)
+	}
+	subscription.PauseCollection.Behavior = ""
+	subscription.CancelAtPeriodEnd = false
+	return nil
+}
+
+func (f *FakeGateway) ChangePlan(subId, plan string, proration stripe.SubscriptionProrationBehavior) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	o := f.next()
+	if o.DeclineCode != "" {
+		return nil, fakeCardError(o.DeclineCode)
+	}
+	subscription, ok := f.Subscriptions[subId]
+	if !ok {
+		return nil, fakeNotFound(subId)
+	}
+	subscription.Items.Data[0].Price = &stripe.Price{ID: plan}
+	return subscription, nil
+}
+
+func (f *FakeGateway) PayInvoice(invoiceID string) (*stripe.Invoice, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, subscription := range f.Subscriptions {
+		invoice := subscription.LatestInvoice
+		if invoice == nil || invoice.ID != invoiceID {
+			continue
+		}
+		invoice.AttemptCount++
+		o := f.next()
+		if o.DeclineCode != "" {
+			return nil, fakeCardError(o.DeclineCode)
+		}
+		invoice.Paid = true
+		invoice.Status = stripe.InvoiceStatusPaid
+		subscription.Status = stripe.SubscriptionStatusActive
+		return invoice, nil
+	}
+	return nil, fakeNotFound(invoiceID)
+}
+
+func (f *FakeGateway) SetSubscriptionPaymentMethod(subId, pm string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	subscription, ok := f.Subscriptions[subId]
+	if !ok {
+		return fakeNotFound(subId)
+	}
+	method, ok := f.PaymentMethods[pm]
+	if !ok {
+		return fakeNotFound(pm)
+	}
+	subscription.DefaultPaymentMethod = method
+	return nil
+}
+
+// WithIdempotencyKey records key and returns the same fake, so state is shared
+func (f *FakeGateway) WithIdempotencyKey(key string) PaymentGateway {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.IdempotencyKeys = append(f.IdempotencyKeys, key)
+	return f
+}
@@ -0,0 +1,32 @@
+package cards
+
+import "github.com/stripe/stripe-go/v72"
+
+// PayInvoice tries the payment of an open invoice again with the card on file,
+// off session. A failed attempt is returned as an error and stripe also sends
+// invoice.payment_failed for it.
+func (c *Card) PayInvoice(invoiceID string) (*stripe.Invoice, error) {
+	params := &stripe.InvoicePayParams{
+		OffSession: stripe.Bool(true),
+	}
+	c.setIdempotencyKey(&params.Params, "pay-invoice")
+	invoice, err := c.api().Invoices.Pay(invoiceID, params)
+	if err != nil {
+		return nil, err
+	}
+	return invoice, nil
+}
+
+// SetSubscriptionPaymentMethod makes pm the card a subscription is charged to.
+// The payment method must already be attached to the subscription's customer.
+func (c *Card) SetSubscriptionPaymentMethod(subId, pm string) error {
+	params := &stripe.SubscriptionParams{
+		DefaultPaymentMethod: stripe.String(pm),
+	}
+	c.setIdempotencyKey(&params.Params, "set-subscription-payment-method")
+	_, err := c.api().Subscriptions.Update(subId, params)
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package cards
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// LineItem is one widget and quantity in a payment intent's items metadata.
+// Price is the unit price charged, fixed when the payment intent was made.
+type LineItem struct {
+	WidgetID int `json:"product_id"`
+	Quantity int `json:"quantity"`
+	Price    int `json:"price,omitempty"`
+}
+
+// EncodeLineItems formats items as "widget:quantity:price,...", which fits a
+// cart of dozens of lines into stripe's 500 character metadata value. The
+// price is left out of lines that have none.
+func EncodeLineItems(items []LineItem) string {
+	parts := make([]string, 0, len(items))
+	for _, item := range items {
+		if item.Price > 0 {
+			parts = append(parts, fmt.Sprintf("%d:%d:%d", item.WidgetID, item.Quantity, item.Price))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d:%d", item.WidgetID, item.Quantity))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseLineItems reads items written by EncodeLineItems
+func ParseLineItems(s string) ([]LineItem, error) {
+	if s == "" {
+		return nil, errors.New("no line items")
+	}
+
+	var items []LineItem
+	for _, part := range strings.Split(s, ",") {
+		// payment intents made before prices were fixed have no price
+		fields := strings.Split(part, ":")
+		if len(fields) != 2 && len(fields) != 3 {
+			return nil, fmt.Errorf("invalid line item %q", part)
+		}
+		widgetID, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid line item %q", part)
+		}
+		quantity, err := strconv.Atoi(fields[1])
+		if err != nil || quantity < 1 {
+			return nil, fmt.Errorf("invalid line item %q", part)
+		}
+		item := LineItem{WidgetID: widgetID, Quantity: quantity}
+		if len(fields) == 3 {
+			item.Price, err = strconv.Atoi(fields[2])
+			if err != nil || item.Price < 1 {
+				return nil, fmt.Errorf("invalid line item %q", part)
+			}
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
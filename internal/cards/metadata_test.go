@@ -0,0 +1,41 @@
+package cards
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEncodeParseLineItems(t *testing.T) {
+	tests := []struct {
+		name    string
+		items   []LineItem
+		encoded string
+	}{
+		{"one line", []LineItem{{WidgetID: 1, Quantity: 2}}, "1:2"},
+		{"several lines", []LineItem{{WidgetID: 1, Quantity: 2}, {WidgetID: 3, Quantity: 1}}, "1:2,3:1"},
+		{"with prices", []LineItem{{WidgetID: 1, Quantity: 2, Price: 1000}, {WidgetID: 3, Quantity: 1, Price: 250}}, "1:2:1000,3:1:250"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := EncodeLineItems(tt.items); got != tt.encoded {
+				t.Errorf("EncodeLineItems() = %q, want %q", got, tt.encoded)
+			}
+			got, err := ParseLineItems(tt.encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.items) {
+				t.Errorf("ParseLineItems() = %v, want %v", got, tt.items)
+			}
+		})
+	}
+}
+
+func TestParseLineItemsInvalid(t *testing.T) {
+	for _, s := range []string{"", "1", "1:0", "x:1", "1:x", "1:2:0", "1:2:x", "1:2:3:4"} {
+		if _, err := ParseLineItems(s); err == nil {
+			t.Errorf("ParseLineItems(%q) did not fail", s)
+		}
+	}
+}
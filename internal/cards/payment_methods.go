@@ -0,0 +1,117 @@
+package cards
+
+import (
+	"github.com/stripe/stripe-go/v72"
+)
+
+// ListPaymentMethods returns the cards attached to a stripe customer
+func (c *Card) ListPaymentMethods(customerID string) ([]*stripe.PaymentMethod, error) {
+	params := &stripe.PaymentMethodListParams{
+		Customer: stripe.String(customerID),
+		Type:     stripe.String(string(stripe.PaymentMethodTypeCard)),
+	}
+	var methods []*stripe.PaymentMethod
+	i := c.api().PaymentMethods.List(params)
+	for i.Next() {
+		methods = append(methods, i.PaymentMethod())
+	}
+	if err := i.Err(); err != nil {
+		return nil, err
+	}
+	return methods, nil
+}
+
+// AttachPaymentMethod attaches a card to a stripe customer so it can be
+// charged again later. The message describes a card error for the customer.
+func (c *Card) AttachPaymentMethod(customerID, pm string) (string, error) {
+	params := &stripe.PaymentMethodAttachParams{
+		Customer: stripe.String(customerID),
+	}
+	c.setIdempotencyKey(&params.Params, "attach")
+	_, err := c.api().PaymentMethods.Attach(pm, params)
+	if err != nil {
+		msg := ""
+		if stripeErr, ok := err.(*stripe.Error); ok {
+			msg = cardErrorMessage(stripeErr.Code)
+		}
+		return msg, err
+	}
+	return "", nil
+}
+
+// DetachPaymentMethod removes a card from its customer. It cannot be charged again.
+func (c *Card) DetachPaymentMethod(pm string) error {
+	params := &stripe.PaymentMethodDetachParams{}
+	c.setIdempotencyKey(&params.Params, "detach")
+	_, err := c.api().PaymentMethods.Detach(pm, params)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// SetDefaultPaymentMethod makes pm the card that a customer's invoices are charged to
+func (c *Card) SetDefaultPaymentMethod(customerID, pm string) (*stripe.Customer, error) {
+	params := &stripe.CustomerParams{
+		InvoiceSettings: &stripe.CustomerInvoiceSettingsParams{
+			DefaultPaymentMethod: stripe.String(pm),
+		},
+	}
+	c.setIdempotencyKey(&params.Params, "default-payment-method")
+	cust, err := c.api().Customers.Update(customerID, params)
+	if err != nil {
+		return nil, err
+	}
+	return cust, nil
+}
+
+// CreateCustomerPaymentIntent creates a payment intent for a stripe customer.
+// The card it is paid with is saved to the customer for later payments.
+func (c *Card) CreateCustomerPaymentIntent(customerID, currency string, amount int, metadata map[string]string) (*stripe.PaymentIntent, string, error) {
+	params := &stripe.PaymentIntentParams{
+		Amount:           stripe.Int64(int64(amount)),
+		Currency:         stripe.String(currency),
+		Customer:         stripe.String(customerID),
+		SetupFutureUsage: stripe.String(string(stripe.PaymentIntentSetupFutureUsageOffSession)),
+	}
+
+	for k, v := range metadata {
+		params.AddMetadata(k, v)
+	}
+
+	c.setIdempotencyKey(&params.Params, "payment-intent")
+	pi, err := c.api().PaymentIntents.New(params)
+	if err != nil {
+		msg := ""
+		if stripeErr, ok := err.(*stripe.Error); ok {
+			msg = cardErrorMessage(stripeErr.Code)
+		}
+		return nil, msg, err
+	}
+	return pi, "", nil
+}
+
+// ChargeSavedCard confirms a customer's payment intent off session with one
+// of their saved cards. When the bank wants the customer to authenticate, the
+// error is returned with the payment intent, which the customer can then
+// confirm on session.
+func (c *Card) ChargeSavedCard(pi, pm string) (*stripe.PaymentIntent, string, error) {
+	params := &stripe.PaymentIntentConfirmParams{
+		PaymentMethod: stripe.String(pm),
+		OffSession:    stripe.Bool(true),
+	}
+	c.setIdempotencyKey(&params.Params, "confirm")
+	intent, err := c.api().PaymentIntents.Confirm(pi, params)
+	if err != nil {
+		msg := ""
+		if stripeErr, ok := err.(*stripe.Error); ok {
+			msg = cardErrorMessage(stripeErr.Code)
+			if stripeErr.Code == stripe.ErrorCodeAuthenticationRequired {
+				msg = "Your bank needs you to confirm this payment"
+				return stripeErr.PaymentIntent, msg, err
+			}
+		}
+		return nil, msg, err
+	}
+	return intent, "", nil
+}
@@ -0,0 +1,131 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// AuthorizationHold is how long stripe keeps a hold on a card for an online
+// payment before it is released if it has not been captured
+const AuthorizationHold = 7 * 24 * time.Hour
+
+// CanCapture reports whether the transaction is an authorization whose hold
+// can still be captured or voided
+func (t Transaction) CanCapture(now time.Time) bool {
+	return t.TransactionStatusID == 6 && now.Before(t.CaptureBefore)
+}
+
+const transactionColumns = `t.id, t.amount, t.currency, t.last_four, t.expiry_month, t.expiry_year,
+	t.payment_intent, t.payment_method, t.bank_return_code, t.transaction_status_id,
+	t.card_brand, t.card_saved, t.authorized_amount, t.capture_before, t.created_at, t.updated_at`
+
+func scanTransaction(row interface{ Scan(...interface{}) error }) (Transaction, error) {
+	var t Transaction
+	var captureBefore sql.NullTime
+	err := row.Scan(
+		&t.ID,
+		&t.Amount,
+		&t.Currency,
+		&t.LastFour,
+		&t.ExpiryMonth,
+		&t.ExpiryYear,
+		&t.PaymentIntent,
+		&t.PaymentMethod,
+		&t.BankReturnCode,
+		&t.TransactionStatusID,
+		&t.CardBrand,
+		&t.CardSaved,
+		&t.AuthorizedAmount,
+		&captureBefore,
+		&t.CreatedAt,
+		&t.UpdatedAt,
+	)
+	t.CaptureBefore = captureBefore.Time
+	return t, err
+}
+
+// GetTerminalSales returns the payments taken in the virtual terminal, which
+// have a transaction but no order, newest first
+func (m *DBModel) GetTerminalSales() ([]Transaction, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT ` + transactionColumns + `
+		FROM transactions t
+		LEFT JOIN orders o ON (o.transaction_id = t.id)
+		WHERE o.id IS NULL
+		ORDER BY t.created_at DESC, t.id DESC`
+
+	rows, err := m.DB.QueryContext(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sales := []Transaction{}
+	for rows.Next() {
+		t, err := scanTransaction(rows)
+		if err != nil {
+			return nil, err
+		}
+		sales = append(sales, t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sales, nil
+}
+
+// GetTransaction returns one transaction by id
+func (m *DBModel) GetTransaction(id int) (Transaction, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT ` + transactionColumns + ` FROM transactions t WHERE t.id = ?`
+
+	return scanTransaction(m.DB.QueryRowContext(ctx, stmt, id))
+}
+
+// CaptureTransaction records that amount of an authorization was captured;
+// the rest of the hold is released, so the transaction is for amount only
+func (m *DBModel) CaptureTransaction(id, amount int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// cleared
+	stmt := `UPDATE transactions SET amount = ?, transaction_status_id = 2, updated_at = ? WHERE id = ?`
+
+	_, err := m.DB.ExecContext(ctx, stmt, amount, time.Now(), id)
+	return err
+}
+
+// CaptureTransactionByPaymentIntent records that amount of the authorization
+// for a payment intent was captured, for captures made outside the sale page
+// such as in the stripe dashboard. Transactions that are not authorizations
+// are left alone.
+func (m *DBModel) CaptureTransactionByPaymentIntent(pi string, amount int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// authorized becomes cleared
+	stmt := `UPDATE transactions SET amount = ?, transaction_status_id = 2, updated_at = ?
+		WHERE payment_intent = ? AND transaction_status_id = 6`
+
+	_, err := m.DB.ExecContext(ctx, stmt, amount, time.Now(), pi)
+	return err
+}
+
+// VoidTransactionByPaymentIntent marks the authorization for a payment intent
+// as voided. Transactions that are not authorizations are left alone.
+func (m *DBModel) VoidTransactionByPaymentIntent(pi string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// authorized becomes voided
+	stmt := `UPDATE transactions SET transaction_status_id = 7, updated_at = ?
+		WHERE payment_intent = ? AND transaction_status_id = 6`
+
+	_, err := m.DB.ExecContext(ctx, stmt, time.Now(), pi)
+	return err
+}
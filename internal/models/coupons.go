@@ -0,0 +1,339 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Coupon discount types
+const (
+	CouponPercent = "percent"
+	CouponFixed   = "fixed"
+)
+
+// Reasons a coupon can not be used; the messages are shown to customers
+var (
+	ErrCouponInactive      = errors.New("this coupon is no longer valid")
+	ErrCouponExpired       = errors.New("this coupon has expired")
+	ErrCouponUsedUp        = errors.New("this coupon has been used up")
+	ErrCouponNotApplicable = errors.New("this coupon does not apply to your order")
+)
+
+// Coupon is a discount code. Amount is a percentage for percent coupons and
+// an amount in Currency for fixed ones. A coupon with a WidgetID only takes
+// money off that widget; one with a zero ExpiresAt never expires, and one with
+// a zero MaxRedemptions can be used any number of times.
+type Coupon struct {
+	ID             int       `json:"id"`
+	Code           string    `json:"code"`
+	Description    string    `json:"description"`
+	DiscountType   string    `json:"discount_type"`
+	Amount         int       `json:"amount"`
+	Currency       string    `json:"currency"`
+	WidgetID       int       `json:"widget_id"`
+	WidgetName     string    `json:"widget_name"`
+	ExpiresAt      time.Time `json:"expires_at"`
+	MaxRedemptions int       `json:"max_redemptions"`
+	IsActive       bool      `json:"is_active"`
+	Redemptions    int       `json:"redemptions"`
+	TotalDiscount  int       `json:"total_discount"`
+	CreatedAt      time.Time `json:"-"`
+	UpdatedAt      time.Time `json:"-"`
+}
+
+// CouponRedemption is one order that used a coupon
+type CouponRedemption struct {
+	ID        int       `json:"id"`
+	CouponID  int       `json:"coupon_id"`
+	OrderID   int       `json:"order_id"`
+	Discount  int       `json:"discount"`
+	Amount    int       `json:"amount"`
+	FirstName string    `json:"first_name"`
+	LastName  string    `json:"last_name"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Usable returns why the coupon can not be redeemed at now, or nil
+func (c Coupon) Usable(now time.Time) error {
+	switch {
+	case !c.IsActive:
+		return ErrCouponInactive
+	case !c.ExpiresAt.IsZero() && now.After(c.ExpiresAt):
+		return ErrCouponExpired
+	case c.MaxRedemptions > 0 && c.Redemptions >= c.MaxRedemptions:
+		return ErrCouponUsedUp
+	}
+	return nil
+}
+
+// Discount returns how much the coupon takes off items paid for in currency.
+// The items must have their prices filled in. Percentages are rounded down,
+// and a fixed discount is never more than the items it applies to.
+func (c Coupon) Discount(items []OrderItem, currency string) (int, error) {
+	eligible := 0
+	for _, item := range items {
+		if c.WidgetID == 0 || item.WidgetID == c.WidgetID {
+			eligible += item.Total()
+		}
+	}
+	if eligible == 0 {
+		return 0, ErrCouponNotApplicable
+	}
+
+	switch c.DiscountType {
+	case CouponPercent:
+		return eligible * c.Amount / 100, nil
+	case CouponFixed:
+		if !strings.EqualFold(c.Currency, currency) {
+			return 0, ErrCouponNotApplicable
+		}
+		if c.Amount > eligible {
+			return eligible, nil
+		}
+		return c.Amount, nil
+	}
+	return 0, fmt.Errorf("coupon %s has unknown discount type %q", c.Code, c.DiscountType)
+}
+
+const couponColumns = `SELECT c.id, c.code, c.description, c.discount_type, c.amount, c.currency,
+		COALESCE(c.widget_id, 0), COALESCE(w.name, ''), c.expires_at, c.max_redemptions, c.is_active,
+		(SELECT COUNT(*) FROM coupon_redemptions r WHERE r.coupon_id = c.id),
+		(SELECT COALESCE(SUM(r.discount), 0) FROM coupon_redemptions r WHERE r.coupon_id = c.id),
+		c.created_at, c.updated_at
+	FROM coupons c
+		LEFT JOIN widgets w ON (c.widget_id = w.id)`
+
+// scanCoupon reads a row selected with couponColumns
+func scanCoupon(row interface{ Scan(...interface{}) error }) (Coupon, error) {
+	var c Coupon
+	var expiresAt sql.NullTime
+	err := row.Scan(
+		&c.ID,
+		&c.Code,
+		&c.Description,
+		&c.DiscountType,
+		&c.Amount,
+		&c.Currency,
+		&c.WidgetID,
+		&c.WidgetName,
+		&expiresAt,
+		&c.MaxRedemptions,
+		&c.IsActive,
+		&c.Redemptions,
+		&c.TotalDiscount,
+		&c.CreatedAt,
+		&c.UpdatedAt,
+	)
+	if expiresAt.Valid {
+		c.ExpiresAt = expiresAt.Time
+	}
+	return c, err
+}
+
+// GetAllCoupons returns every coupon with how often it was redeemed, newest first
+func (m *DBModel) GetAllCoupons() ([]*Coupon, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, couponColumns+` ORDER BY c.created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var coupons []*Coupon
+	for rows.Next() {
+		c, err := scanCoupon(rows)
+		if err != nil {
+			return nil, err
+		}
+		coupons = append(coupons, &c)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return coupons, nil
+}
+
+// GetCoupon returns one coupon by id
+func (m *DBModel) GetCoupon(id int) (Coupon, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return scanCoupon(m.DB.QueryRowContext(ctx, couponColumns+` WHERE c.id = ?`, id))
+}
+
+// GetCouponByCode returns the coupon for a code as typed by a customer
+func (m *DBModel) GetCouponByCode(code string) (Coupon, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return scanCoupon(m.DB.QueryRowContext(ctx, couponColumns+` WHERE c.code = ?`, strings.ToUpper(strings.TrimSpace(code))))
+}
+
+// nullWidget stores a zero widget id as null, meaning every widget
+func nullWidget(id int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(id), Valid: id > 0}
+}
+
+// nullTime stores a zero time as null
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// AddCoupon inserts a new coupon and returns its id. Codes are stored in
+// upper case so customers can type them either way.
+func (m *DBModel) AddCoupon(c Coupon) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `INSERT INTO coupons
+		(code, description, discount_type, amount, currency, widget_id, expires_at, max_redemptions, is_active, created_at, updated_at)
+		VALUES (?,?,?,?,?,?,?,?,?,?,?)`
+
+	result, err := m.DB.ExecContext(ctx, stmt,
+		strings.ToUpper(c.Code),
+		c.Description,
+		c.DiscountType,
+		c.Amount,
+		c.Currency,
+		nullWidget(c.WidgetID),
+		nullTime(c.ExpiresAt),
+		c.MaxRedemptions,
+		c.IsActive,
+		time.Now(),
+		time.Now())
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), nil
+}
+
+// EditCoupon updates a coupon
+func (m *DBModel) EditCoupon(c Coupon) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `UPDATE coupons SET
+		code = ?,
+		description = ?,
+		discount_type = ?,
+		amount = ?,
+		currency = ?,
+		widget_id = ?,
+		expires_at = ?,
+		max_redemptions = ?,
+		is_active = ?,
+		updated_at = ?
+	WHERE id = ?`
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		strings.ToUpper(c.Code),
+		c.Description,
+		c.DiscountType,
+		c.Amount,
+		c.Currency,
+		nullWidget(c.WidgetID),
+		nullTime(c.ExpiresAt),
+		c.MaxRedemptions,
+		c.IsActive,
+		time.Now(),
+		c.ID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetCouponRedemptions returns the orders that used a coupon, newest first
+func (m *DBModel) GetCouponRedemptions(couponID int) ([]CouponRedemption, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT r.id, r.coupon_id, r.order_id, r.discount, o.amount, c.first_name, c.last_name, c.email, r.created_at
+		FROM coupon_redemptions r
+			INNER JOIN orders o ON (r.order_id = o.id)
+			LEFT JOIN customers c ON (o.customer_id = c.id)
+		WHERE r.coupon_id = ?
+		ORDER BY r.created_at DESC`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, couponID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var redemptions []CouponRedemption
+	for rows.Next() {
+		var x CouponRedemption
+		err = rows.Scan(
+			&x.ID,
+			&x.CouponID,
+			&x.OrderID,
+			&x.Discount,
+			&x.Amount,
+			&x.FirstName,
+			&x.LastName,
+			&x.Email,
+			&x.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		redemptions = append(redemptions, x)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return redemptions, nil
+}
+
+// reserveCoupon holds one redemption of a coupon for a payment intent, so a
+// coupon with a MaxRedemptions can not be used by more checkouts than it has
+// redemptions left. It returns ErrCouponUsedUp, and reserves nothing, when
+// every redemption is taken.
+func reserveCoupon(ctx context.Context, tx *sql.Tx, pi string, couponID int) error {
+	var max int
+	err := tx.QueryRowContext(ctx, `SELECT max_redemptions FROM coupons WHERE id = ? FOR UPDATE`, couponID).Scan(&max)
+	if err != nil {
+		return err
+	}
+	if max == 0 {
+		return nil
+	}
+
+	stmt := `SELECT
+		(SELECT COUNT(*) FROM coupon_redemptions WHERE coupon_id = ?) +
+		(SELECT COUNT(*) FROM coupon_reservations WHERE coupon_id = ? AND expires_at > ? AND payment_intent <> ?)`
+
+	var taken int
+	err = tx.QueryRowContext(ctx, stmt, couponID, couponID, time.Now(), pi).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken >= max {
+		return ErrCouponUsedUp
+	}
+
+	stmt = `INSERT INTO coupon_reservations (payment_intent, coupon_id, expires_at, created_at, updated_at)
+		VALUES (?,?,?,?,?)`
+	_, err = tx.ExecContext(ctx, stmt, pi, couponID, time.Now().Add(StockReservationTTL), time.Now(), time.Now())
+	return err
+}
+
+func insertCouponRedemption(ctx context.Context, db execer, couponID, orderID, discount int) error {
+	stmt := `INSERT INTO coupon_redemptions (coupon_id, order_id, discount, created_at, updated_at)
+		VALUES (?,?,?,?,?)`
+
+	_, err := db.ExecContext(ctx, stmt, couponID, orderID, discount, time.Now(), time.Now())
+	return err
+}
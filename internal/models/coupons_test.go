@@ -0,0 +1,73 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCouponUsable(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		coupon Coupon
+		want   error
+	}{
+		{"active", Coupon{IsActive: true}, nil},
+		{"inactive", Coupon{IsActive: false}, ErrCouponInactive},
+		{"not yet expired", Coupon{IsActive: true, ExpiresAt: now.Add(time.Hour)}, nil},
+		{"expired", Coupon{IsActive: true, ExpiresAt: now.Add(-time.Hour)}, ErrCouponExpired},
+		{"redemptions left", Coupon{IsActive: true, MaxRedemptions: 2, Redemptions: 1}, nil},
+		{"used up", Coupon{IsActive: true, MaxRedemptions: 2, Redemptions: 2}, ErrCouponUsedUp},
+		{"unlimited", Coupon{IsActive: true, Redemptions: 100}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.coupon.Usable(now); !errors.Is(got, tt.want) {
+				t.Errorf("Usable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCouponDiscount(t *testing.T) {
+	items := []OrderItem{
+		{WidgetID: 1, Quantity: 2, Price: 1000},
+		{WidgetID: 2, Quantity: 1, Price: 500},
+	}
+
+	tests := []struct {
+		name     string
+		coupon   Coupon
+		currency string
+		want     int
+		wantErr  error
+	}{
+		{"percent of the order", Coupon{DiscountType: CouponPercent, Amount: 10}, "inr", 250, nil},
+		{"percent rounded down", Coupon{DiscountType: CouponPercent, Amount: 15, WidgetID: 2}, "inr", 75, nil},
+		{"percent of one widget", Coupon{DiscountType: CouponPercent, Amount: 50, WidgetID: 1}, "inr", 1000, nil},
+		{"fixed", Coupon{DiscountType: CouponFixed, Amount: 300, Currency: "inr"}, "inr", 300, nil},
+		{"fixed currency case", Coupon{DiscountType: CouponFixed, Amount: 300, Currency: "INR"}, "inr", 300, nil},
+		{"fixed capped at the items", Coupon{DiscountType: CouponFixed, Amount: 900, Currency: "inr", WidgetID: 2}, "inr", 500, nil},
+		{"fixed in another currency", Coupon{DiscountType: CouponFixed, Amount: 300, Currency: "usd"}, "inr", 0, ErrCouponNotApplicable},
+		{"widget not in the order", Coupon{DiscountType: CouponPercent, Amount: 10, WidgetID: 3}, "inr", 0, ErrCouponNotApplicable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.coupon.Discount(items, tt.currency)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Discount() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Discount() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := (Coupon{DiscountType: "bogus", Amount: 1}).Discount(items, "inr"); err == nil {
+		t.Error("Discount() with an unknown type did not fail")
+	}
+}
@@ -0,0 +1,71 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// GetOrdersForCustomerEmail returns every order placed under an email
+// address, newest first. Customers may have more than one row for the same
+// email from before they were reused, so this matches on the email itself.
+func (m *DBModel) GetOrdersForCustomerEmail(email string) ([]*Order, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `select
+				o.id, o.widget_id, o.transaction_id, o.customer_id, o.status_id, o.quantity, o.amount, o.created_at, o.updated_at,
+				w.id, w.name, w.is_recurring, t.id, t.amount, t.currency, t.last_four, t.payment_intent,
+				c.id, c.first_name, c.last_name, c.email
+			from
+				orders o
+				left join widgets w on (o.widget_id = w.id)
+				left join transactions t on (o.transaction_id = t.id)
+				inner join customers c on (o.customer_id = c.id)
+			where
+				c.email = ?
+			order by
+				o.created_at desc`
+
+	var orders []*Order
+
+	rows, err := m.DB.QueryContext(ctx, stmt, email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var o Order
+		err = rows.Scan(
+			&o.ID,
+			&o.WidgetID,
+			&o.TransactionID,
+			&o.CustomerID,
+			&o.StatusID,
+			&o.Quantity,
+			&o.Amount,
+			&o.CreatedAt,
+			&o.UpdatedAt,
+			&o.Widget.ID,
+			&o.Widget.Name,
+			&o.Widget.IsRecurring,
+			&o.Transaction.ID,
+			&o.Transaction.Amount,
+			&o.Transaction.Currency,
+			&o.Transaction.LastFour,
+			&o.Transaction.PaymentIntent,
+			&o.Customer.ID,
+			&o.Customer.FirstName,
+			&o.Customer.LastName,
+			&o.Customer.Email,
+		)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, &o)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
@@ -0,0 +1,119 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// PastDueInvoice is a failed subscription renewal that is being chased
+type PastDueInvoice struct {
+	ID            int       `json:"id"`
+	OrderID       int       `json:"order_id"`
+	InvoiceID     string    `json:"invoice_id"`
+	Attempts      int       `json:"attempts"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	CreatedAt     time.Time `json:"-"`
+	UpdatedAt     time.Time `json:"-"`
+}
+
+// RecordPaymentFailure records a failed payment of a renewal invoice and when
+// to try it again, and marks the subscription order past due
+func (m *DBModel) RecordPaymentFailure(orderID int, invoiceID string, attempts int, nextAttemptAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.WithTx(ctx, func(tx *sql.Tx) error {
+		stmt := `INSERT INTO past_due_invoices (order_id, invoice_id, attempts, next_attempt_at, created_at, updated_at)
+			VALUES (?,?,?,?,?,?)
+			ON DUPLICATE KEY UPDATE attempts = VALUES(attempts), next_attempt_at = VALUES(next_attempt_at), updated_at = VALUES(updated_at)`
+
+		_, err := tx.ExecContext(ctx, stmt, orderID, invoiceID, attempts, nextAttemptAt, time.Now(), time.Now())
+		if err != nil {
+			return err
+		}
+
+		// cleared or trialing
+		stmt = `UPDATE orders SET status_id = 7, updated_at = ? WHERE id = ? AND status_id IN (1, 6)`
+
+		_, err = tx.ExecContext(ctx, stmt, time.Now(), orderID)
+		return err
+	})
+}
+
+// GetDueInvoiceRetries returns the past due invoices whose next retry is due
+func (m *DBModel) GetDueInvoiceRetries(now time.Time) ([]PastDueInvoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT id, order_id, invoice_id, attempts, next_attempt_at, created_at, updated_at
+		FROM past_due_invoices
+		WHERE next_attempt_at <= ?
+		ORDER BY next_attempt_at`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invoices []PastDueInvoice
+	for rows.Next() {
+		var p PastDueInvoice
+		err = rows.Scan(
+			&p.ID,
+			&p.OrderID,
+			&p.InvoiceID,
+			&p.Attempts,
+			&p.NextAttemptAt,
+			&p.CreatedAt,
+			&p.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		invoices = append(invoices, p)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return invoices, nil
+}
+
+// ClearNextAttempt stops an invoice being retried again until its next
+// failure is recorded. A failure recorded since attempts was read has already
+// scheduled the next retry, which is kept.
+func (m *DBModel) ClearNextAttempt(invoiceID string, attempts int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `UPDATE past_due_invoices SET next_attempt_at = NULL, updated_at = ? WHERE invoice_id = ? AND attempts = ?`
+
+	_, err := m.DB.ExecContext(ctx, stmt, time.Now(), invoiceID, attempts)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ResolvePastDueInvoice stops chasing an invoice once it is paid or the
+// subscription is cancelled. A past due order that was paid is active again.
+func (m *DBModel) ResolvePastDueInvoice(invoiceID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.WithTx(ctx, func(tx *sql.Tx) error {
+		stmt := `UPDATE orders o
+				INNER JOIN past_due_invoices p ON (p.order_id = o.id)
+			SET o.status_id = 1, o.updated_at = ?
+			WHERE p.invoice_id = ? AND o.status_id = 7`
+
+		_, err := tx.ExecContext(ctx, stmt, time.Now(), invoiceID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `DELETE FROM past_due_invoices WHERE invoice_id = ?`, invoiceID)
+		return err
+	})
+}
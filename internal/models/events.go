@@ -0,0 +1,40 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// InsertStripeEvent records a stripe webhook event. It returns false when the
+// event has already been recorded, so the caller can skip it.
+func (m *DBModel) InsertStripeEvent(eventID, eventType string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `INSERT IGNORE INTO stripe_events (event_id, event_type, created_at, updated_at)
+		VALUES (?,?,?,?)`
+
+	result, err := m.DB.ExecContext(ctx, stmt, eventID, eventType, time.Now(), time.Now())
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+// DeleteStripeEvent forgets a recorded event so that stripe's retry is processed again
+func (m *DBModel) DeleteStripeEvent(eventID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `DELETE FROM stripe_events WHERE event_id = ?`
+
+	_, err := m.DB.ExecContext(ctx, stmt, eventID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// IdempotencyKeyTTL is how long a response is kept for replay; after that
+// the key can be used again
+const IdempotencyKeyTTL = 24 * time.Hour
+
+// IdempotencyLockTimeout is how long a key stays reserved by a request that
+// never stored a response, such as one whose server was restarted
+const IdempotencyLockTimeout = 5 * time.Minute
+
+// IdempotentResponse is the first response given for an Idempotency-Key. A
+// Status of 0 means the first request is still being processed.
+type IdempotentResponse struct {
+	Key       string    `json:"key"`
+	Path      string    `json:"path"`
+	Hash      string    `json:"hash"`
+	Status    int       `json:"status"`
+	Body      []byte    `json:"-"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+}
+
+// ReserveIdempotencyKey claims key for a request to path whose body hashes to
+// hash. It returns false if the key has been used before. Keys whose response
+// has expired, or whose request stopped without a response, are claimed again.
+func (m *DBModel) ReserveIdempotencyKey(key, path, hash string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	now := time.Now()
+
+	stmt := `DELETE FROM idempotency_keys WHERE idempotency_key = ?
+		AND (created_at < ? OR (response_status = 0 AND updated_at < ?))`
+
+	_, err := m.DB.ExecContext(ctx, stmt, key, now.Add(-IdempotencyKeyTTL), now.Add(-IdempotencyLockTimeout))
+	if err != nil {
+		return false, err
+	}
+
+	stmt = `INSERT IGNORE INTO idempotency_keys (idempotency_key, request_path, request_hash, response_status, created_at, updated_at)
+		VALUES (?,?,?,0,?,?)`
+
+	result, err := m.DB.ExecContext(ctx, stmt, key, path, hash, now, now)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+// GetIdempotentResponse gets the stored response for key
+func (m *DBModel) GetIdempotentResponse(key string) (IdempotentResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var resp IdempotentResponse
+
+	stmt := `SELECT idempotency_key, request_path, request_hash, response_status, COALESCE(response_body, ''), created_at, updated_at
+		FROM idempotency_keys WHERE idempotency_key = ?`
+
+	err := m.DB.QueryRowContext(ctx, stmt, key).Scan(
+		&resp.Key,
+		&resp.Path,
+		&resp.Hash,
+		&resp.Status,
+		&resp.Body,
+		&resp.CreatedAt,
+		&resp.UpdatedAt,
+	)
+	if err != nil {
+		return resp, err
+	}
+	return resp, nil
+}
+
+// SaveIdempotentResponse stores the response given for key so it can be replayed
+func (m *DBModel) SaveIdempotentResponse(key string, status int, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `UPDATE idempotency_keys SET response_status = ?, response_body = ?, updated_at = ?
+		WHERE idempotency_key = ?`
+
+	_, err := m.DB.ExecContext(ctx, stmt, status, body, time.Now(), key)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteIdempotencyKey releases key so that the request can be tried again
+func (m *DBModel) DeleteIdempotencyKey(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `DELETE FROM idempotency_keys WHERE idempotency_key = ?`
+
+	_, err := m.DB.ExecContext(ctx, stmt, key)
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -4,12 +4,19 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"myapp/internal/money"
+	"myapp/internal/tax"
 	"strings"
 	"time"
 
+	"github.com/go-sql-driver/mysql"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// ErrDuplicatePayment is returned when a payment intent has already been recorded
+var ErrDuplicatePayment = errors.New("payment intent has already been recorded")
+
 //DBModel is the type for database connection values
 type DBModel struct {
 	DB *sql.DB
@@ -39,8 +46,44 @@ type Widget struct {
 	Image          string    `json:"image"`
 	IsRecurring    bool      `json:"is_recurring"`
 	PlanID         string    `json:"plan_id"`
+	IsActive       bool      `json:"is_active"`
+	TrialDays      int       `json:"trial_days"`
 	CreatedAt      time.Time `json:"-"`
 	UpdatedAt      time.Time `json:"-"`
+	// Available is the inventory level less reserved stock; it is only filled in where shown to customers
+	Available int `json:"available"`
+	// Price is in money.DefaultCurrency; Prices are what the widget sells for
+	// in other currencies. GetWidget fills them in.
+	Prices []WidgetPrice `json:"prices"`
+}
+
+// WidgetPrice is the price of a widget in one currency other than money.DefaultCurrency
+type WidgetPrice struct {
+	Currency string `json:"currency"`
+	Price    int    `json:"price"`
+}
+
+// PriceIn returns the price of the widget in currency, if it is sold in it
+func (w Widget) PriceIn(currency string) (int, bool) {
+	if strings.EqualFold(currency, money.DefaultCurrency) {
+		return w.Price, true
+	}
+	for _, p := range w.Prices {
+		if strings.EqualFold(p.Currency, currency) {
+			return p.Price, true
+		}
+	}
+	return 0, false
+}
+
+// AllPrices returns the price of the widget in every currency it is sold in,
+// money.DefaultCurrency first
+func (w Widget) AllPrices() []money.Money {
+	prices := []money.Money{money.New(w.Price, money.DefaultCurrency)}
+	for _, p := range w.Prices {
+		prices = append(prices, money.New(p.Price, p.Currency))
+	}
+	return prices
 }
 
 //Order type for all orders
@@ -57,6 +100,25 @@ type Order struct {
 	Widget        Widget      `json:"widget"`
 	Transaction   Transaction `json:"transaction"`
 	Customer      Customer    `json:"customer"`
+	// Items are the lines of the order. WidgetID and Quantity above hold the
+	// first widget and the total number of units, so orders still list by type.
+	Items []OrderItem `json:"items"`
+	// Refunds, RefundedAmount and RefundableAmount are only filled in by GetOrderById
+	Refunds          []Refund `json:"refunds"`
+	RefundedAmount   int      `json:"refunded_amount"`
+	RefundableAmount int      `json:"refundable"`
+	// Discount is what a coupon took off; Amount is what was charged after it
+	Discount int `json:"discount"`
+	CouponID int `json:"coupon_id"`
+	// Tax is the GST in Amount, charged as TaxLines on a sale to TaxState
+	Tax      int        `json:"tax"`
+	TaxState string     `json:"tax_state"`
+	TaxLines []tax.Line `json:"tax_lines"`
+}
+
+// Money returns the amount charged for the order in the currency it was paid in
+func (o Order) Money() money.Money {
+	return money.New(o.Amount, o.Transaction.Currency)
 }
 
 //Status type for all order status
@@ -77,18 +139,29 @@ type TransactionStatus struct {
 
 //transaction type for transaction
 type Transaction struct {
-	ID                  int       `json:"id"`
-	Amount              int       `json:"amount"`
-	Currency            string    `json:"currency"`
-	LastFour            string    `json:"last_four"`
-	ExpiryMonth         int       `json:"expiry_month"`
-	ExpiryYear          int       `json:"expiry_year"`
-	PaymentIntent       string    `json:"payment_intent"`
-	PaymentMethod       string    `json:"payment_method"`
-	BankReturnCode      string    `json:"bank_return_code"`
-	TransactionStatusID int       `json:"transaction_status_id"`
-	CreatedAt           time.Time `json:"-"`
-	UpdatedAt           time.Time `json:"-"`
+	ID                  int    `json:"id"`
+	Amount              int    `json:"amount"`
+	Currency            string `json:"currency"`
+	LastFour            string `json:"last_four"`
+	ExpiryMonth         int    `json:"expiry_month"`
+	ExpiryYear          int    `json:"expiry_year"`
+	PaymentIntent       string `json:"payment_intent"`
+	PaymentMethod       string `json:"payment_method"`
+	BankReturnCode      string `json:"bank_return_code"`
+	TransactionStatusID int    `json:"transaction_status_id"`
+	CardBrand           string `json:"card_brand"`
+	CardSaved           bool   `json:"card_saved"`
+	// AuthorizedAmount is the hold placed on the card of a manual capture
+	// payment, which must be captured or voided before CaptureBefore
+	AuthorizedAmount int       `json:"authorized_amount"`
+	CaptureBefore    time.Time `json:"capture_before"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"-"`
+}
+
+// Money returns the amount of the transaction in its currency
+func (t Transaction) Money() money.Money {
+	return money.New(t.Amount, t.Currency)
 }
 
 //Users is the type for all users
@@ -104,14 +177,18 @@ type Users struct {
 
 //Customer is the type for all Customers
 type Customer struct {
-	ID          int       `json:"id"`
-	FirstName   string    `json:"first_name"`
-	LastName    string    `json:"last_name"`
-	Email       string    `json:"email"`
-	ExpiryMonth string    `json:"expiry_month"`
-	ExpiryYear  string    `json:"expiry_year"`
-	CreatedAt   time.Time `json:"-"`
-	UpdatedAt   time.Time `json:"-"`
+	ID               int       `json:"id"`
+	FirstName        string    `json:"first_name"`
+	LastName         string    `json:"last_name"`
+	Email            string    `json:"email"`
+	StripeCustomerID string    `json:"stripe_customer_id"`
+	ExpiryMonth      string    `json:"expiry_month"`
+	ExpiryYear       string    `json:"expiry_year"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"-"`
+	// SignedIn is set when the customer proved they own Email by signing
+	// in; anyone can type an email at checkout
+	SignedIn bool `json:"-"`
 }
 
 //GetWidget get one widget by id
@@ -120,7 +197,7 @@ func (m *DBModel) GetWidget(id int) (Widget, error) {
 	defer cancel()
 
 	var widget Widget
-	row := m.DB.QueryRowContext(ctx, `SELECT id, name ,description ,inventory_level ,price, COALESCE(image,''), is_recurring, plan_id, created_at, updated_at 
+	row := m.DB.QueryRowContext(ctx, `SELECT id, name ,description ,inventory_level ,price, COALESCE(image,''), is_recurring, plan_id, is_active, trial_days, created_at, updated_at 
 		FROM widgets where id=?`, id)
 
 	err := row.Scan(&widget.ID,
@@ -131,25 +208,43 @@ func (m *DBModel) GetWidget(id int) (Widget, error) {
 		&widget.Image,
 		&widget.IsRecurring,
 		&widget.PlanID,
+		&widget.IsActive,
+		&widget.TrialDays,
 		&widget.CreatedAt,
 		&widget.UpdatedAt,
 	)
 	if err != nil {
 		return widget, err
 	}
+
+	widget.Prices, err = getWidgetPrices(ctx, m.DB, widget.ID)
+	if err != nil {
+		return widget, err
+	}
 	return widget, nil
 }
 
+// execer is implemented by both *sql.DB and *sql.Tx, so inserts can run inside or outside a transaction
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
 //InsertTransaction insert a new transaction and returns its id
 func (m *DBModel) InsertTransaction(txn Transaction) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	return insertTransaction(ctx, m.DB, txn)
+}
+
+func insertTransaction(ctx context.Context, db execer, txn Transaction) (int, error) {
 	stmt := `INSERT INTO transactions
-		(amount,currency, last_four, bank_return_code,transaction_status_id,expiry_month,expiry_year,payment_intent,payment_method,created_at,updated_at)
-		VALUES (?,?,?,?,?,?,?,?,?,?,?)`
+		(amount,currency, last_four, bank_return_code,transaction_status_id,expiry_month,expiry_year,payment_intent,payment_method,card_brand,card_saved,authorized_amount,capture_before,created_at,updated_at)
+		VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`
 
-	result, err := m.DB.ExecContext(ctx, stmt,
+	result, err := db.ExecContext(ctx, stmt,
 		txn.Amount,
 		txn.Currency,
 		txn.LastFour,
@@ -159,6 +254,10 @@ func (m *DBModel) InsertTransaction(txn Transaction) (int, error) {
 		txn.ExpiryYear,
 		txn.PaymentIntent,
 		txn.PaymentMethod,
+		txn.CardBrand,
+		txn.CardSaved,
+		txn.AuthorizedAmount,
+		nullTime(txn.CaptureBefore),
 		time.Now(),
 		time.Now())
 
@@ -177,16 +276,23 @@ func (m *DBModel) InsertOrder(order Order) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	return insertOrder(ctx, m.DB, order)
+}
+
+func insertOrder(ctx context.Context, db execer, order Order) (int, error) {
 	stmt := `INSERT INTO orders
-		(widget_id,transaction_id, status_id, quantity,amount,customer_id,created_at,updated_at)
-		VALUES (?,?,?,?,?,?,?,?)`
+		(widget_id,transaction_id, status_id, quantity,amount,discount,tax,tax_state,customer_id,created_at,updated_at)
+		VALUES (?,?,?,?,?,?,?,?,?,?,?)`
 
-	result, err := m.DB.ExecContext(ctx, stmt,
+	result, err := db.ExecContext(ctx, stmt,
 		order.WidgetID,
 		order.TransactionID,
 		order.StatusID,
 		order.Quantity,
 		order.Amount,
+		order.Discount,
+		order.Tax,
+		order.TaxState,
 		order.CustomerID,
 		time.Now(),
 		time.Now())
@@ -206,14 +312,24 @@ func (m *DBModel) InsertCustomer(customer Customer) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	return insertCustomer(ctx, m.DB, customer)
+}
+
+func insertCustomer(ctx context.Context, db execer, customer Customer) (int, error) {
 	stmt := `INSERT INTO customers
-		(first_name,last_name, email, created_at,updated_at)
-		VALUES (?,?,?,?,?)`
+		(first_name,last_name, email, stripe_customer_id, created_at,updated_at)
+		VALUES (?,?,?,?,?,?)`
+
+	var stripeCustomerID interface{}
+	if customer.StripeCustomerID != "" {
+		stripeCustomerID = customer.StripeCustomerID
+	}
 
-	result, err := m.DB.ExecContext(ctx, stmt,
+	result, err := db.ExecContext(ctx, stmt,
 		customer.FirstName,
 		customer.LastName,
 		customer.Email,
+		stripeCustomerID,
 		time.Now(),
 		time.Now())
 
@@ -227,6 +343,172 @@ func (m *DBModel) InsertCustomer(customer Customer) (int, error) {
 	return int(id), nil
 }
 
+// GetCustomerByEmail returns the oldest customer with the given email
+func (m *DBModel) GetCustomerByEmail(email string) (Customer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var c Customer
+	stmt := `SELECT id, first_name, last_name, email, COALESCE(stripe_customer_id, ''), created_at, updated_at
+		FROM customers
+		WHERE email = ?
+		ORDER BY id
+		LIMIT 1`
+
+	err := m.DB.QueryRowContext(ctx, stmt, strings.TrimSpace(email)).Scan(
+		&c.ID,
+		&c.FirstName,
+		&c.LastName,
+		&c.Email,
+		&c.StripeCustomerID,
+		&c.CreatedAt,
+		&c.UpdatedAt,
+	)
+	if err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// upsertCustomer returns the id of the customer with the same email, and
+// inserts a new customer otherwise. Only a signed in customer updates their
+// name and stripe customer id; checkout input reuses a customer with the same
+// stripe customer untouched and is a new customer otherwise.
+func upsertCustomer(ctx context.Context, db execer, customer Customer) (int, error) {
+	customer.Email = strings.TrimSpace(customer.Email)
+
+	var id int
+	if !customer.SignedIn {
+		stmt := `SELECT id FROM customers WHERE email = ? AND COALESCE(stripe_customer_id, '') = ?
+			ORDER BY id LIMIT 1`
+		err := db.QueryRowContext(ctx, stmt, customer.Email, customer.StripeCustomerID).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return insertCustomer(ctx, db, customer)
+		} else if err != nil {
+			return 0, err
+		}
+		return id, nil
+	}
+
+	stmt := `SELECT id FROM customers WHERE email = ? ORDER BY id LIMIT 1 FOR UPDATE`
+	err := db.QueryRowContext(ctx, stmt, customer.Email).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return insertCustomer(ctx, db, customer)
+	} else if err != nil {
+		return 0, err
+	}
+
+	stmt = `UPDATE customers SET
+		first_name = ?,
+		last_name = ?,
+		stripe_customer_id = COALESCE(NULLIF(?, ''), stripe_customer_id),
+		updated_at = ?
+	WHERE id = ?`
+
+	_, err = db.ExecContext(ctx, stmt,
+		customer.FirstName,
+		customer.LastName,
+		customer.StripeCustomerID,
+		time.Now(),
+		id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// WithTx runs fn inside a database transaction. The transaction is committed
+// when fn returns nil and rolled back on any error.
+func (m *DBModel) WithTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return fmt.Errorf("%v (rollback failed: %v)", err, rbErr)
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// CreateOrderWithPayment saves the customer, transaction, order and order items
+// for a checkout in one database transaction and returns the new order id
+func (m *DBModel) CreateOrderWithPayment(customer Customer, txn Transaction, order Order) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var orderID int
+	err := m.WithTx(ctx, func(tx *sql.Tx) error {
+		customerID, err := upsertCustomer(ctx, tx, customer)
+		if err != nil {
+			return err
+		}
+
+		txnID, err := insertTransaction(ctx, tx, txn)
+		if err != nil {
+			return err
+		}
+
+		order.CustomerID = customerID
+		order.TransactionID = txnID
+		orderID, err = insertOrder(ctx, tx, order)
+		if err != nil {
+			return err
+		}
+
+		if order.CouponID > 0 {
+			err = insertCouponRedemption(ctx, tx, order.CouponID, orderID, order.Discount)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, line := range order.TaxLines {
+			err = insertOrderTax(ctx, tx, orderID, line)
+			if err != nil {
+				return err
+			}
+		}
+
+		items := order.Items
+		if len(items) == 0 && order.Quantity > 0 {
+			// a single widget order, such as a subscription
+			items = []OrderItem{{
+				WidgetID: order.WidgetID,
+				Quantity: order.Quantity,
+				Price:    order.Amount / order.Quantity,
+			}}
+		}
+		for _, item := range items {
+			item.OrderID = orderID
+			_, err = insertOrderItem(ctx, tx, item)
+			if err != nil {
+				return err
+			}
+			err = takeStock(ctx, tx, item)
+			if err != nil {
+				return err
+			}
+		}
+
+		// the stock and coupon are now used, so the payment intent no longer holds them
+		return releaseReservations(ctx, tx, txn.PaymentIntent)
+	})
+	if err != nil {
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 {
+			// transactions.payment_intent is unique
+			return 0, ErrDuplicatePayment
+		}
+		return 0, err
+	}
+	return orderID, nil
+}
+
 //GetUserByEmail get a user by email address
 func (m *DBModel) GetUserByEmail(email string) (Users, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -431,7 +713,7 @@ func (m *DBModel) GetOrderById(orderId int) (Order, error) {
 	defer cancel()
 
 	stmt := `select 
-				o.id,o.widget_id,o.transaction_id,o.customer_id, o.status_id,o.quantity, o.amount, o.created_at, o.updated_at, w.id, w.name, t.id,t.amount ,t.currency , t.last_four ,t.expiry_month,
+				o.id,o.widget_id,o.transaction_id,o.customer_id, o.status_id,o.quantity, o.amount, o.discount, o.tax, o.tax_state, o.created_at, o.updated_at, w.id, w.name, t.id,t.amount ,t.currency , t.last_four ,t.expiry_month,
 				t.expiry_year ,t.payment_intent ,t.bank_return_code , c.id,c.first_name ,c.last_name ,c.email 
 			from 
 				orders o
@@ -453,6 +735,9 @@ func (m *DBModel) GetOrderById(orderId int) (Order, error) {
 		&o.StatusID,
 		&o.Quantity,
 		&o.Amount,
+		&o.Discount,
+		&o.Tax,
+		&o.TaxState,
 		&o.CreatedAt,
 		&o.UpdatedAt,
 		&o.Widget.ID,
@@ -473,9 +758,45 @@ func (m *DBModel) GetOrderById(orderId int) (Order, error) {
 	if err != nil {
 		return o, err
 	}
+
+	o.Items, err = m.GetOrderItems(o.ID)
+	if err != nil {
+		return o, err
+	}
+
+	o.TaxLines, err = m.GetOrderTaxes(o.ID)
+	if err != nil {
+		return o, err
+	}
+
+	o.Refunds, err = m.GetRefundsForOrder(o.ID)
+	if err != nil {
+		return o, err
+	}
+	for _, x := range o.Refunds {
+		o.RefundedAmount += x.Amount
+	}
+	o.RefundableAmount = o.Refundable()
+
 	return o, nil
 }
 
+// GetOrderByPaymentIntent gets the order paid for by a payment intent
+func (m *DBModel) GetOrderByPaymentIntent(pi string) (Order, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT o.id FROM orders o INNER JOIN transactions t ON (o.transaction_id = t.id)
+		WHERE t.payment_intent = ?`
+
+	var orderID int
+	err := m.DB.QueryRowContext(ctx, stmt, pi).Scan(&orderID)
+	if err != nil {
+		return Order{}, err
+	}
+	return m.GetOrderById(orderID)
+}
+
 func (m *DBModel) UpdateOrderStatus(id, statusID int) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -603,3 +924,34 @@ func (m *DBModel) DeleteUser(id int) error {
 
 	return nil
 }
+
+// UpdateTransactionStatusByPaymentIntent sets the status of the transaction for a payment intent or subscription id
+func (m *DBModel) UpdateTransactionStatusByPaymentIntent(pi string, statusID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `UPDATE transactions SET transaction_status_id = ?, updated_at = ? WHERE payment_intent = ?`
+
+	_, err := m.DB.ExecContext(ctx, stmt, statusID, time.Now(), pi)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// UpdateOrderStatusByPaymentIntent sets the status of the order paid by a payment intent or subscription id
+func (m *DBModel) UpdateOrderStatusByPaymentIntent(pi string, statusID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `UPDATE orders o
+			INNER JOIN transactions t ON (o.transaction_id = t.id)
+		SET o.status_id = ?, o.updated_at = ?
+		WHERE t.payment_intent = ?`
+
+	_, err := m.DB.ExecContext(ctx, stmt, statusID, time.Now(), pi)
+	if err != nil {
+		return err
+	}
+	return nil
+}
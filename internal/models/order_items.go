@@ -0,0 +1,86 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// OrderItem is one line of an order: a widget, how many were bought and the
+// unit price charged for it
+type OrderItem struct {
+	ID        int       `json:"id"`
+	OrderID   int       `json:"order_id"`
+	WidgetID  int       `json:"widget_id"`
+	Quantity  int       `json:"quantity"`
+	Price     int       `json:"price"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+	Widget    Widget    `json:"widget"`
+}
+
+// Total returns the line total
+func (i OrderItem) Total() int {
+	return i.Price * i.Quantity
+}
+
+func insertOrderItem(ctx context.Context, db execer, item OrderItem) (int, error) {
+	stmt := `INSERT INTO order_items
+		(order_id, widget_id, quantity, price, created_at, updated_at)
+		VALUES (?,?,?,?,?,?)`
+
+	result, err := db.ExecContext(ctx, stmt,
+		item.OrderID,
+		item.WidgetID,
+		item.Quantity,
+		item.Price,
+		time.Now(),
+		time.Now())
+
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), nil
+}
+
+// GetOrderItems returns the lines of an order
+func (m *DBModel) GetOrderItems(orderID int) ([]OrderItem, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT i.id, i.order_id, i.widget_id, i.quantity, i.price, i.created_at, i.updated_at, w.id, w.name
+		FROM order_items i
+			LEFT JOIN widgets w ON (i.widget_id = w.id)
+		WHERE i.order_id = ?
+		ORDER BY i.id`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []OrderItem{}
+	for rows.Next() {
+		var i OrderItem
+		err = rows.Scan(
+			&i.ID,
+			&i.OrderID,
+			&i.WidgetID,
+			&i.Quantity,
+			&i.Price,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Widget.ID,
+			&i.Widget.Name,
+		)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	return items, rows.Err()
+}
@@ -0,0 +1,43 @@
+package models
+
+import (
+	"context"
+	"myapp/internal/tax"
+	"time"
+)
+
+func insertOrderTax(ctx context.Context, db execer, orderID int, line tax.Line) error {
+	stmt := `INSERT INTO order_taxes (order_id, name, rate, amount, created_at, updated_at)
+		VALUES (?,?,?,?,?,?)`
+
+	_, err := db.ExecContext(ctx, stmt, orderID, line.Name, line.Rate, line.Amount, time.Now(), time.Now())
+	return err
+}
+
+// GetOrderTaxes returns the tax lines charged on an order
+func (m *DBModel) GetOrderTaxes(orderID int) ([]tax.Line, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT name, rate, amount FROM order_taxes WHERE order_id = ? ORDER BY id`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lines := []tax.Line{}
+	for rows.Next() {
+		var l tax.Line
+		err = rows.Scan(&l.Name, &l.Rate, &l.Amount)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, l)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
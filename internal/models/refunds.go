@@ -0,0 +1,125 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Refund is one refund against an order. An order may have several partial refunds.
+type Refund struct {
+	ID             int       `json:"id"`
+	OrderID        int       `json:"order_id"`
+	Amount         int       `json:"amount"`
+	Reason         string    `json:"reason"`
+	StripeRefundID string    `json:"stripe_refund_id"`
+	RefundedBy     string    `json:"refunded_by"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"-"`
+}
+
+// Refundable returns how much of the captured amount has not been refunded yet
+func (o *Order) Refundable() int {
+	refundable := o.Transaction.Amount - o.RefundedAmount
+	if refundable < 0 {
+		return 0
+	}
+	return refundable
+}
+
+// RecordRefund adds a refund to the ledger and updates the transaction and
+// order statuses to match. A refund that is already recorded is ignored, and
+// the order's items go back into stock once it is fully refunded.
+func (m *DBModel) RecordRefund(refund Refund) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.WithTx(ctx, func(tx *sql.Tx) error {
+		stmt := `INSERT IGNORE INTO refunds (order_id, amount, reason, stripe_refund_id, refunded_by, created_at, updated_at)
+			VALUES (?,?,?,?,?,?,?)`
+
+		_, err := tx.ExecContext(ctx, stmt,
+			refund.OrderID,
+			refund.Amount,
+			refund.Reason,
+			refund.StripeRefundID,
+			refund.RefundedBy,
+			time.Now(),
+			time.Now(),
+		)
+		if err != nil {
+			return err
+		}
+
+		var transactionID, captured, refunded int
+		stmt = `SELECT t.id, t.amount, COALESCE(SUM(r.amount), 0)
+			FROM orders o
+				INNER JOIN transactions t ON (o.transaction_id = t.id)
+				LEFT JOIN refunds r ON (r.order_id = o.id)
+			WHERE o.id = ?
+			GROUP BY t.id, t.amount`
+		err = tx.QueryRowContext(ctx, stmt, refund.OrderID).Scan(&transactionID, &captured, &refunded)
+		if err != nil {
+			return err
+		}
+
+		// transaction partially refunded
+		txnStatus := 5
+		if refunded >= captured {
+			// transaction refunded, order refunded
+			txnStatus = 4
+			result, err := tx.ExecContext(ctx, `UPDATE orders SET status_id = 2, updated_at = ? WHERE id = ? AND status_id <> 2`, time.Now(), refund.OrderID)
+			if err != nil {
+				return err
+			}
+			// put the stock back the first time the order is fully refunded
+			if n, _ := result.RowsAffected(); n > 0 {
+				err = restockOrder(ctx, tx, refund.OrderID)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		_, err = tx.ExecContext(ctx, `UPDATE transactions SET transaction_status_id = ?, updated_at = ? WHERE id = ?`,
+			txnStatus, time.Now(), transactionID)
+		return err
+	})
+}
+
+// GetRefundsForOrder returns the refunds for an order, oldest first
+func (m *DBModel) GetRefundsForOrder(orderID int) ([]Refund, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT id, order_id, amount, reason, stripe_refund_id, refunded_by, created_at, updated_at
+		FROM refunds
+		WHERE order_id = ?
+		ORDER BY created_at, id`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var refunds []Refund
+	for rows.Next() {
+		var r Refund
+		err = rows.Scan(
+			&r.ID,
+			&r.OrderID,
+			&r.Amount,
+			&r.Reason,
+			&r.StripeRefundID,
+			&r.RefundedBy,
+			&r.CreatedAt,
+			&r.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		refunds = append(refunds, r)
+	}
+	return refunds, nil
+}
@@ -0,0 +1,56 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// Revenue totals the payments taken in one currency. Amounts in different
+// currencies can not be added up, so the report has one of these per currency.
+type Revenue struct {
+	Currency string `json:"currency"`
+	Payments int    `json:"payments"`
+	Gross    int    `json:"gross"`
+	Refunded int    `json:"refunded"`
+	Net      int    `json:"net"`
+}
+
+// GetRevenueByCurrency returns the revenue from every cleared or refunded
+// payment, one row per currency
+func (m *DBModel) GetRevenueByCurrency() ([]Revenue, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT t.currency, count(t.id), coalesce(sum(t.amount), 0), coalesce(sum(rf.refunded), 0)
+		FROM transactions t
+		LEFT JOIN (
+			SELECT o.transaction_id, sum(r.amount) AS refunded
+			FROM refunds r
+			INNER JOIN orders o ON (r.order_id = o.id)
+			GROUP BY o.transaction_id
+		) rf ON (rf.transaction_id = t.id)
+		WHERE t.transaction_status_id IN (2, 4, 5)
+		GROUP BY t.currency
+		ORDER BY t.currency`
+
+	rows, err := m.DB.QueryContext(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revenue := []Revenue{}
+	for rows.Next() {
+		var r Revenue
+		err = rows.Scan(&r.Currency, &r.Payments, &r.Gross, &r.Refunded)
+		if err != nil {
+			return nil, err
+		}
+		r.Net = r.Gross - r.Refunded
+		revenue = append(revenue, r)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return revenue, nil
+}
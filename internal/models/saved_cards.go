@@ -0,0 +1,97 @@
+package models
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// SavedCard is a card attached to a stripe customer, described from the
+// transactions it paid for
+type SavedCard struct {
+	PaymentMethod    string `json:"payment_method"`
+	CardBrand        string `json:"card_brand"`
+	LastFour         string `json:"last_four"`
+	ExpiryMonth      int    `json:"expiry_month"`
+	ExpiryYear       int    `json:"expiry_year"`
+	StripeCustomerID string `json:"stripe_customer_id"`
+	FirstName        string `json:"first_name"`
+	LastName         string `json:"last_name"`
+	Email            string `json:"email"`
+}
+
+// Expired reports whether the card expired before the current month
+func (c SavedCard) Expired() bool {
+	now := time.Now()
+	return c.ExpiryYear < now.Year() || (c.ExpiryYear == now.Year() && c.ExpiryMonth < int(now.Month()))
+}
+
+// GetSavedCards returns the saved cards among the given payment methods, most
+// recently used first. Expired cards are left out.
+func (m *DBModel) GetSavedCards(paymentMethods []string) ([]SavedCard, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var cards []SavedCard
+	if len(paymentMethods) == 0 {
+		return cards, nil
+	}
+
+	args := make([]interface{}, len(paymentMethods))
+	for i, pm := range paymentMethods {
+		args[i] = pm
+	}
+
+	stmt := `SELECT t.payment_method, t.card_brand, t.last_four, t.expiry_month, t.expiry_year,
+			COALESCE(c.stripe_customer_id, ''), c.first_name, c.last_name, c.email
+		FROM transactions t
+			INNER JOIN orders o ON (o.transaction_id = t.id)
+			INNER JOIN customers c ON (o.customer_id = c.id)
+		WHERE t.card_saved = 1 AND t.payment_method IN (?` + strings.Repeat(",?", len(args)-1) + `)
+		ORDER BY t.id DESC`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var c SavedCard
+		err = rows.Scan(
+			&c.PaymentMethod,
+			&c.CardBrand,
+			&c.LastFour,
+			&c.ExpiryMonth,
+			&c.ExpiryYear,
+			&c.StripeCustomerID,
+			&c.FirstName,
+			&c.LastName,
+			&c.Email,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if seen[c.PaymentMethod] || c.Expired() {
+			continue
+		}
+		seen[c.PaymentMethod] = true
+		cards = append(cards, c)
+	}
+	return cards, nil
+}
+
+// ForgetSavedCard stops offering a payment method as a saved card
+func (m *DBModel) ForgetSavedCard(pm string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `UPDATE transactions SET card_saved = 0, updated_at = ? WHERE payment_method = ?`
+
+	_, err := m.DB.ExecContext(ctx, stmt, time.Now(), pm)
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// StockReservationTTL is how long a payment intent holds stock before it is
+// released for other customers, in case the customer never pays
+const StockReservationTTL = 30 * time.Minute
+
+// OutOfStockError is returned when a widget does not have enough stock left
+type OutOfStockError struct {
+	WidgetID  int
+	Name      string
+	Available int
+}
+
+func (e *OutOfStockError) Error() string {
+	if e.Available <= 0 {
+		return fmt.Sprintf("%s is out of stock", e.Name)
+	}
+	return fmt.Sprintf("only %d of %s left in stock", e.Available, e.Name)
+}
+
+// availableStock returns the inventory level of a widget less what unexpired
+// reservations hold, ignoring reservations made by excludePI
+func availableStock(ctx context.Context, db execer, widgetID int, excludePI string) (int, error) {
+	stmt := `SELECT w.inventory_level - COALESCE(SUM(r.quantity), 0)
+		FROM widgets w
+			LEFT JOIN stock_reservations r ON (r.widget_id = w.id AND r.expires_at > ? AND r.payment_intent <> ?)
+		WHERE w.id = ?
+		GROUP BY w.id, w.inventory_level`
+
+	var available int
+	err := db.QueryRowContext(ctx, stmt, time.Now(), excludePI, widgetID).Scan(&available)
+	if err != nil {
+		return 0, err
+	}
+	return available, nil
+}
+
+// GetAvailableStock returns how many of a widget can still be sold
+func (m *DBModel) GetAvailableStock(widgetID int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	available, err := availableStock(ctx, m.DB, widgetID, "")
+	if err != nil {
+		return 0, err
+	}
+	if available < 0 {
+		return 0, nil
+	}
+	return available, nil
+}
+
+// ReserveStock holds stock for the items of a payment intent, and a redemption
+// of its coupon when couponID is not 0, until the order is saved, the
+// reservation is released or it expires. It returns an *OutOfStockError or
+// ErrCouponUsedUp, and reserves nothing, when any item or the coupon is short.
+func (m *DBModel) ReserveStock(pi string, items []OrderItem, couponID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// lock widgets in id order so concurrent checkouts cannot deadlock
+	sorted := make([]OrderItem, len(items))
+	copy(sorted, items)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].WidgetID < sorted[j].WidgetID })
+
+	return m.WithTx(ctx, func(tx *sql.Tx) error {
+		// expired reservations are left for the api to cancel their payment
+		// intents; availableStock already ignores them
+		for _, item := range sorted {
+			var name string
+			err := tx.QueryRowContext(ctx, `SELECT name FROM widgets WHERE id = ? FOR UPDATE`, item.WidgetID).Scan(&name)
+			if err != nil {
+				return err
+			}
+
+			available, err := availableStock(ctx, tx, item.WidgetID, pi)
+			if err != nil {
+				return err
+			}
+			if available < item.Quantity {
+				return &OutOfStockError{WidgetID: item.WidgetID, Name: name, Available: available}
+			}
+
+			stmt := `INSERT INTO stock_reservations (payment_intent, widget_id, quantity, expires_at, created_at, updated_at)
+				VALUES (?,?,?,?,?,?)`
+			_, err = tx.ExecContext(ctx, stmt,
+				pi,
+				item.WidgetID,
+				item.Quantity,
+				time.Now().Add(StockReservationTTL),
+				time.Now(),
+				time.Now(),
+			)
+			if err != nil {
+				return err
+			}
+		}
+
+		if couponID > 0 {
+			return reserveCoupon(ctx, tx, pi, couponID)
+		}
+		return nil
+	})
+}
+
+// ReleaseStock drops the stock and coupon reservations held by a payment intent
+func (m *DBModel) ReleaseStock(pi string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.WithTx(ctx, func(tx *sql.Tx) error {
+		return releaseReservations(ctx, tx, pi)
+	})
+}
+
+func releaseReservations(ctx context.Context, db execer, pi string) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM stock_reservations WHERE payment_intent = ?`, pi)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `DELETE FROM coupon_reservations WHERE payment_intent = ?`, pi)
+	return err
+}
+
+// GetExpiredReservations returns the payment intents whose stock or coupon
+// reservations expired before now
+func (m *DBModel) GetExpiredReservations(now time.Time) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT payment_intent FROM stock_reservations WHERE expires_at <= ?
+		UNION
+		SELECT payment_intent FROM coupon_reservations WHERE expires_at <= ?`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, now, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pis []string
+	for rows.Next() {
+		var pi string
+		if err := rows.Scan(&pi); err != nil {
+			return nil, err
+		}
+		pis = append(pis, pi)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return pis, nil
+}
+
+// takeStock decrements inventory for a sold item. Subscriptions are not
+// stocked. It returns an *OutOfStockError, and takes nothing, when there is
+// not enough stock left.
+func takeStock(ctx context.Context, db execer, item OrderItem) error {
+	stmt := `UPDATE widgets SET inventory_level = inventory_level - ?, updated_at = ?
+		WHERE id = ? AND is_recurring = 0 AND inventory_level >= ?`
+
+	result, err := db.ExecContext(ctx, stmt, item.Quantity, time.Now(), item.WidgetID, item.Quantity)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows > 0 {
+		return nil
+	}
+
+	var name string
+	var recurring bool
+	var level int
+	stmt = `SELECT name, is_recurring, inventory_level FROM widgets WHERE id = ?`
+	err = db.QueryRowContext(ctx, stmt, item.WidgetID).Scan(&name, &recurring, &level)
+	if err != nil {
+		return err
+	}
+	if recurring {
+		return nil
+	}
+	return &OutOfStockError{WidgetID: item.WidgetID, Name: name, Available: level}
+}
+
+// restockOrder puts the items of an order back into inventory
+func restockOrder(ctx context.Context, db execer, orderID int) error {
+	stmt := `UPDATE widgets w
+			INNER JOIN order_items i ON (i.widget_id = w.id)
+		SET w.inventory_level = w.inventory_level + i.quantity, w.updated_at = ?
+		WHERE i.order_id = ? AND w.is_recurring = 0`
+
+	_, err := db.ExecContext(ctx, stmt, time.Now(), orderID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// ChangeSubscriptionPlan moves a subscription order and its item to another
+// plan widget, recording amount as what the subscription now costs each
+// period. The transaction is left alone: it is what the customer was charged.
+func (m *DBModel) ChangeSubscriptionPlan(orderID int, plan Widget, amount int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.WithTx(ctx, func(tx *sql.Tx) error {
+		stmt := `UPDATE orders SET widget_id = ?, amount = ?, updated_at = ? WHERE id = ?`
+		_, err := tx.ExecContext(ctx, stmt, plan.ID, amount, time.Now(), orderID)
+		if err != nil {
+			return err
+		}
+
+		stmt = `UPDATE order_items SET widget_id = ?, price = ? DIV quantity, updated_at = ? WHERE order_id = ?`
+		_, err = tx.ExecContext(ctx, stmt, plan.ID, amount, time.Now(), orderID)
+		return err
+	})
+}
+
+// ClearSubscriptionTransaction marks the transaction of a subscription as
+// cleared. A trial's transaction was recorded at 0 while nothing had been
+// charged, so its first payment records amount.
+func (m *DBModel) ClearSubscriptionTransaction(subID string, amount int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// pending becomes cleared
+	stmt := `UPDATE transactions
+		SET amount = IF(transaction_status_id = 1 AND amount = 0, ?, amount), transaction_status_id = 2, updated_at = ?
+		WHERE payment_intent = ?`
+
+	_, err := m.DB.ExecContext(ctx, stmt, amount, time.Now(), subID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// UpdateSubscriptionStatus sets the status of a subscription order by its
+// stripe subscription id. Orders already cancelled or refunded are left alone.
+func (m *DBModel) UpdateSubscriptionStatus(subID string, statusID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// cleared, pending cancellation, paused, trialing or past due
+	stmt := `UPDATE orders o
+			INNER JOIN transactions t ON (o.transaction_id = t.id)
+		SET o.status_id = ?, o.updated_at = ?
+		WHERE t.payment_intent = ? AND o.status_id IN (1, 4, 5, 6, 7)`
+
+	_, err := m.DB.ExecContext(ctx, stmt, statusID, time.Now(), subID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// GetAllWidgets returns every widget, retired ones included, ordered by name
+func (m *DBModel) GetAllWidgets() ([]*Widget, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT id, name, description, inventory_level, price, COALESCE(image,''), is_recurring, plan_id, is_active, trial_days, created_at, updated_at
+		FROM widgets
+		ORDER BY name`
+
+	rows, err := m.DB.QueryContext(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var widgets []*Widget
+	for rows.Next() {
+		var w Widget
+		err = rows.Scan(
+			&w.ID,
+			&w.Name,
+			&w.Description,
+			&w.InventoryLevel,
+			&w.Price,
+			&w.Image,
+			&w.IsRecurring,
+			&w.PlanID,
+			&w.IsActive,
+			&w.TrialDays,
+			&w.CreatedAt,
+			&w.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		widgets = append(widgets, &w)
+	}
+	return widgets, nil
+}
+
+// AddWidget inserts a new widget with its prices and returns its id
+func (m *DBModel) AddWidget(w Widget) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `INSERT INTO widgets
+		(name, description, inventory_level, price, image, is_recurring, plan_id, is_active, trial_days, created_at, updated_at)
+		VALUES (?,?,?,?,?,?,?,?,?,?,?)`
+
+	var id int
+	err := m.WithTx(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, stmt,
+			w.Name,
+			w.Description,
+			w.InventoryLevel,
+			w.Price,
+			w.Image,
+			w.IsRecurring,
+			w.PlanID,
+			w.IsActive,
+			w.TrialDays,
+			time.Now(),
+			time.Now())
+		if err != nil {
+			return err
+		}
+		lastID, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		id = int(lastID)
+		return setWidgetPrices(ctx, tx, id, w.Prices)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// EditWidget updates a widget and replaces its prices
+func (m *DBModel) EditWidget(w Widget) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `UPDATE widgets SET
+		name = ?,
+		description = ?,
+		inventory_level = ?,
+		price = ?,
+		image = ?,
+		is_recurring = ?,
+		plan_id = ?,
+		is_active = ?,
+		trial_days = ?,
+		updated_at = ?
+	WHERE id = ?`
+
+	return m.WithTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, stmt,
+			w.Name,
+			w.Description,
+			w.InventoryLevel,
+			w.Price,
+			w.Image,
+			w.IsRecurring,
+			w.PlanID,
+			w.IsActive,
+			w.TrialDays,
+			time.Now(),
+			w.ID)
+		if err != nil {
+			return err
+		}
+		return setWidgetPrices(ctx, tx, w.ID, w.Prices)
+	})
+}
+
+// RetireWidget takes a widget off sale. Widgets are never deleted, since
+// orders refer to them.
+func (m *DBModel) RetireWidget(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `UPDATE widgets SET is_active = 0, updated_at = ? WHERE id = ?`
+
+	_, err := m.DB.ExecContext(ctx, stmt, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetPlans returns the subscription plans that are on sale, cheapest first
+func (m *DBModel) GetPlans() ([]*Widget, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT id, name, description, inventory_level, price, COALESCE(image,''), is_recurring, plan_id, is_active, trial_days, created_at, updated_at
+		FROM widgets
+		WHERE is_recurring = 1 AND is_active = 1
+		ORDER BY price, name`
+
+	rows, err := m.DB.QueryContext(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var plans []*Widget
+	for rows.Next() {
+		var w Widget
+		err = rows.Scan(
+			&w.ID,
+			&w.Name,
+			&w.Description,
+			&w.InventoryLevel,
+			&w.Price,
+			&w.Image,
+			&w.IsRecurring,
+			&w.PlanID,
+			&w.IsActive,
+			&w.TrialDays,
+			&w.CreatedAt,
+			&w.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, &w)
+	}
+	return plans, nil
+}
+
+// getWidgetPrices returns the prices of a widget in currencies other than the default
+func getWidgetPrices(ctx context.Context, db execer, widgetID int) ([]WidgetPrice, error) {
+	stmt := `SELECT currency, price FROM widget_prices WHERE widget_id = ? ORDER BY currency`
+
+	rows, err := db.QueryContext(ctx, stmt, widgetID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prices := []WidgetPrice{}
+	for rows.Next() {
+		var p WidgetPrice
+		err = rows.Scan(&p.Currency, &p.Price)
+		if err != nil {
+			return nil, err
+		}
+		prices = append(prices, p)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return prices, nil
+}
+
+func setWidgetPrices(ctx context.Context, db execer, widgetID int, prices []WidgetPrice) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM widget_prices WHERE widget_id = ?`, widgetID)
+	if err != nil {
+		return err
+	}
+
+	stmt := `INSERT INTO widget_prices (widget_id, currency, price, created_at, updated_at)
+		VALUES (?,?,?,?,?)`
+
+	for _, p := range prices {
+		_, err = db.ExecContext(ctx, stmt, widgetID, strings.ToLower(p.Currency), p.Price, time.Now(), time.Now())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+// Package money handles amounts of money the way stripe stores them: a whole
+// number of the currency's minor unit, such as paise for rupees, together
+// with the lower case ISO 4217 code of the currency.
+package money
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultCurrency is the currency widgets are priced in
+const DefaultCurrency = "inr"
+
+// Money is an amount in the minor unit of Currency
+type Money struct {
+	Amount   int    `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// New returns amount minor units of currency; an empty currency is DefaultCurrency
+func New(amount int, currency string) Money {
+	currency = strings.ToLower(strings.TrimSpace(currency))
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	return Money{Amount: amount, Currency: currency}
+}
+
+// zero and three decimal currencies; every other currency has two decimals
+var exponents = map[string]int{
+	"bif": 0, "clp": 0, "djf": 0, "gnf": 0, "jpy": 0, "kmf": 0, "krw": 0, "mga": 0,
+	"pyg": 0, "rwf": 0, "ugx": 0, "vnd": 0, "vuv": 0, "xaf": 0, "xof": 0, "xpf": 0,
+	"bhd": 3, "jod": 3, "kwd": 3, "omr": 3, "tnd": 3,
+}
+
+// Exponent returns how many digits of currency come after the decimal point
+func Exponent(currency string) int {
+	if e, ok := exponents[strings.ToLower(currency)]; ok {
+		return e
+	}
+	return 2
+}
+
+var symbols = map[string]string{
+	"inr": "₹",
+	"usd": "$",
+	"eur": "€",
+	"gbp": "£",
+	"jpy": "¥",
+	"aud": "A$",
+	"cad": "CA$",
+	"sgd": "S$",
+}
+
+// Symbol returns the sign written before amounts of currency, or its upper
+// case code and a space for currencies without one
+func Symbol(currency string) string {
+	if s, ok := symbols[strings.ToLower(currency)]; ok {
+		return s
+	}
+	return strings.ToUpper(currency) + " "
+}
+
+// String formats m for people, e.g. ₹1,23,456.50 or $123,456.50
+func (m Money) String() string {
+	return m.format(Symbol(m.Currency))
+}
+
+// Text formats m with its currency code, e.g. INR 1,23,456.50, for fonts
+// that have no currency symbols
+func (m Money) Text() string {
+	return m.format(strings.ToUpper(m.Currency) + " ")
+}
+
+func (m Money) format(prefix string) string {
+	sign := ""
+	amount := m.Amount
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	major, minor := m.split(amount)
+	s := sign + prefix + group(major, m.Currency)
+	if e := Exponent(m.Currency); e > 0 {
+		s += fmt.Sprintf(".%0*d", e, minor)
+	}
+	return s
+}
+
+// Major formats m as a plain decimal number without grouping, e.g. 123456.50,
+// for form inputs
+func (m Money) Major() string {
+	sign := ""
+	amount := m.Amount
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	major, minor := m.split(amount)
+	if e := Exponent(m.Currency); e > 0 {
+		return fmt.Sprintf("%s%d.%0*d", sign, major, e, minor)
+	}
+	return fmt.Sprintf("%s%d", sign, major)
+}
+
+func (m Money) split(amount int) (int, int) {
+	unit := 1
+	for i := 0; i < Exponent(m.Currency); i++ {
+		unit *= 10
+	}
+	return amount / unit, amount % unit
+}
+
+// group puts thousands separators into a whole number; rupees are grouped
+// the Indian way, in a thousand and then in lakhs and crores
+func group(n int, currency string) string {
+	digits := fmt.Sprintf("%d", n)
+	if len(digits) <= 3 {
+		return digits
+	}
+
+	head, tail := digits[:len(digits)-3], digits[len(digits)-3:]
+	size := 3
+	if strings.EqualFold(currency, "inr") {
+		size = 2
+	}
+	var parts []string
+	for len(head) > size {
+		parts = append([]string{head[len(head)-size:]}, parts...)
+		head = head[:len(head)-size]
+	}
+	parts = append([]string{head}, parts...)
+	return strings.Join(append(parts, tail), ",")
+}
@@ -0,0 +1,82 @@
+package money
+
+import "testing"
+
+func TestGroup(t *testing.T) {
+	tests := []struct {
+		n        int
+		currency string
+		want     string
+	}{
+		{0, "inr", "0"},
+		{999, "inr", "999"},
+		{1000, "inr", "1,000"},
+		{123456, "inr", "1,23,456"},
+		{12345678, "inr", "1,23,45,678"},
+		{1000, "usd", "1,000"},
+		{123456, "usd", "123,456"},
+		{12345678, "usd", "12,345,678"},
+	}
+
+	for _, tt := range tests {
+		if got := group(tt.n, tt.currency); got != tt.want {
+			t.Errorf("group(%d, %q) = %q, want %q", tt.n, tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestExponent(t *testing.T) {
+	tests := []struct {
+		currency string
+		want     int
+	}{
+		{"inr", 2},
+		{"USD", 2},
+		{"jpy", 0},
+		{"kwd", 3},
+	}
+
+	for _, tt := range tests {
+		if got := Exponent(tt.currency); got != tt.want {
+			t.Errorf("Exponent(%q) = %d, want %d", tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestMajor(t *testing.T) {
+	tests := []struct {
+		m    Money
+		want string
+	}{
+		{New(12345650, "inr"), "123456.50"},
+		{New(5, "usd"), "0.05"},
+		{New(-150, "eur"), "-1.50"},
+		{New(1500, "jpy"), "1500"},
+		{New(1234, "kwd"), "1.234"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.m.Major(); got != tt.want {
+			t.Errorf("%v.Major() = %q, want %q", tt.m, got, tt.want)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		m    Money
+		want string
+	}{
+		{New(12345650, ""), "₹1,23,456.50"},
+		{New(12345650, "USD"), "$123,456.50"},
+		{New(-150, "gbp"), "-£1.50"},
+		{New(1500, "jpy"), "¥1,500"},
+		{New(1000, "chf"), "CHF 10.00"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.m.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
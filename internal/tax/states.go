@@ -0,0 +1,70 @@
+package tax
+
+import "sort"
+
+// State is an Indian state or union territory as the GST system numbers it
+type State struct {
+	Code string `json:"code"`
+	Name string `json:"name"`
+	// UnionTerritory is set for union territories without a legislature,
+	// which charge UTGST instead of SGST
+	UnionTerritory bool `json:"union_territory"`
+}
+
+// states are keyed by the two digit code that also starts every GSTIN
+var states = map[string]State{
+	"01": {Code: "01", Name: "Jammu and Kashmir"},
+	"02": {Code: "02", Name: "Himachal Pradesh"},
+	"03": {Code: "03", Name: "Punjab"},
+	"04": {Code: "04", Name: "Chandigarh", UnionTerritory: true},
+	"05": {Code: "05", Name: "Uttarakhand"},
+	"06": {Code: "06", Name: "Haryana"},
+	"07": {Code: "07", Name: "Delhi"},
+	"08": {Code: "08", Name: "Rajasthan"},
+	"09": {Code: "09", Name: "Uttar Pradesh"},
+	"10": {Code: "10", Name: "Bihar"},
+	"11": {Code: "11", Name: "Sikkim"},
+	"12": {Code: "12", Name: "Arunachal Pradesh"},
+	"13": {Code: "13", Name: "Nagaland"},
+	"14": {Code: "14", Name: "Manipur"},
+	"15": {Code: "15", Name: "Mizoram"},
+	"16": {Code: "16", Name: "Tripura"},
+	"17": {Code: "17", Name: "Meghalaya"},
+	"18": {Code: "18", Name: "Assam"},
+	"19": {Code: "19", Name: "West Bengal"},
+	"20": {Code: "20", Name: "Jharkhand"},
+	"21": {Code: "21", Name: "Odisha"},
+	"22": {Code: "22", Name: "Chhattisgarh"},
+	"23": {Code: "23", Name: "Madhya Pradesh"},
+	"24": {Code: "24", Name: "Gujarat"},
+	"26": {Code: "26", Name: "Dadra and Nagar Haveli and Daman and Diu", UnionTerritory: true},
+	"27": {Code: "27", Name: "Maharashtra"},
+	"29": {Code: "29", Name: "Karnataka"},
+	"30": {Code: "30", Name: "Goa"},
+	"31": {Code: "31", Name: "Lakshadweep", UnionTerritory: true},
+	"32": {Code: "32", Name: "Kerala"},
+	"33": {Code: "33", Name: "Tamil Nadu"},
+	"34": {Code: "34", Name: "Puducherry"},
+	"35": {Code: "35", Name: "Andaman and Nicobar Islands", UnionTerritory: true},
+	"36": {Code: "36", Name: "Telangana"},
+	"37": {Code: "37", Name: "Andhra Pradesh"},
+	"38": {Code: "38", Name: "Ladakh", UnionTerritory: true},
+}
+
+// LookupState returns the state with a GST state code
+func LookupState(code string) (State, bool) {
+	s, ok := states[code]
+	return s, ok
+}
+
+// States returns every state, sorted by name for a select box
+func States() []State {
+	list := make([]State, 0, len(states))
+	for _, s := range states {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
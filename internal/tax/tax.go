@@ -0,0 +1,156 @@
+// Package tax works out the goods and services tax (GST) on a sale. A sale
+// within the seller's state pays central tax (CGST) and state tax (SGST, or
+// UTGST in a union territory); a sale to another state pays integrated tax
+// (IGST) at the full rate.
+package tax
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Line is one tax charged on a sale. Rate is in basis points, so 900 is 9%.
+type Line struct {
+	Name   string `json:"name"`
+	Rate   int    `json:"rate"`
+	Amount int    `json:"amount"`
+}
+
+// Percent formats the rate of the line, e.g. "9%" or "2.5%"
+func (l Line) Percent() string {
+	return strconv.FormatFloat(float64(l.Rate)/100, 'f', -1, 64) + "%"
+}
+
+// Calculator charges GST at one rate for a seller registered in SellerState.
+// Rate is in basis points. Without a SellerState or Rate no tax is charged.
+type Calculator struct {
+	SellerState string
+	Rate        int
+}
+
+// Enabled reports whether the calculator charges any tax
+func (c Calculator) Enabled() bool {
+	return c.SellerState != "" && c.Rate > 0
+}
+
+// Lines returns the taxes on a taxable amount sold to a buyer in buyerState
+func (c Calculator) Lines(taxable int, buyerState string) ([]Line, error) {
+	if !c.Enabled() {
+		return nil, nil
+	}
+	buyer, ok := LookupState(buyerState)
+	if !ok {
+		return nil, fmt.Errorf("unknown state code %q", buyerState)
+	}
+
+	if buyer.Code != c.SellerState {
+		return []Line{{Name: "IGST", Rate: c.Rate, Amount: percentOf(taxable, c.Rate)}}, nil
+	}
+
+	// the rate is split evenly, and each half is rounded on its own so the two match
+	half := c.Rate / 2
+	local := "SGST"
+	if buyer.UnionTerritory {
+		local = "UTGST"
+	}
+	return []Line{
+		{Name: "CGST", Rate: half, Amount: percentOf(taxable, half)},
+		{Name: local, Rate: half, Amount: percentOf(taxable, half)},
+	}, nil
+}
+
+// percentOf returns rate basis points of amount, rounded to the nearest unit
+func percentOf(amount, rate int) int {
+	return (amount*rate + 5000) / 10000
+}
+
+// Total adds up the tax lines
+func Total(lines []Line) int {
+	total := 0
+	for _, l := range lines {
+		total += l.Amount
+	}
+	return total
+}
+
+// ParseRate reads a percentage such as "18" or "0.5" as basis points. The
+// rate must be a whole number of basis points once halved, as a sale within
+// the seller's state pays half as CGST and half as SGST.
+func ParseRate(s string) (int, error) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || f < 0 || f > 100 {
+		return 0, fmt.Errorf("invalid tax rate %q", s)
+	}
+	bp := math.Round(f * 100)
+	if math.Abs(bp-f*100) > 1e-6 {
+		return 0, fmt.Errorf("invalid tax rate %q: at most two decimal places", s)
+	}
+	if int(bp)%2 != 0 {
+		return 0, fmt.Errorf("invalid tax rate %q: it cannot be split evenly into CGST and SGST", s)
+	}
+	return int(bp), nil
+}
+
+// EncodeLines formats lines as "name:rate:amount,name:rate:amount" for a
+// payment intent's metadata
+func EncodeLines(lines []Line) string {
+	parts := make([]string, 0, len(lines))
+	for _, l := range lines {
+		parts = append(parts, fmt.Sprintf("%s:%d:%d", l.Name, l.Rate, l.Amount))
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseLines reads lines written by EncodeLines. An empty string is no tax.
+func ParseLines(s string) ([]Line, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var lines []Line
+	for _, part := range strings.Split(s, ",") {
+		fields := strings.Split(part, ":")
+		if len(fields) != 3 || fields[0] == "" {
+			return nil, fmt.Errorf("invalid tax line %q", part)
+		}
+		rate, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid tax line %q", part)
+		}
+		amount, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid tax line %q", part)
+		}
+		lines = append(lines, Line{Name: fields[0], Rate: rate, Amount: amount})
+	}
+	return lines, nil
+}
+
+var gstinFormat = regexp.MustCompile(`^[0-9]{2}[A-Z]{5}[0-9]{4}[A-Z][1-9A-Z]Z[0-9A-Z]$`)
+
+const gstinChars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// CheckGSTIN checks the format, state code and check digit of a GST
+// identification number
+func CheckGSTIN(gstin string) error {
+	if !gstinFormat.MatchString(gstin) {
+		return errors.New("a GSTIN is 15 characters: state code, PAN, entity number, Z and a check digit")
+	}
+	if _, ok := LookupState(gstin[:2]); !ok {
+		return fmt.Errorf("GSTIN %s has unknown state code %s", gstin, gstin[:2])
+	}
+
+	sum := 0
+	for i := 0; i < 14; i++ {
+		p := strings.IndexByte(gstinChars, gstin[i]) * (i%2 + 1)
+		sum += p/36 + p%36
+	}
+	if gstinChars[(36-sum%36)%36] != gstin[14] {
+		return fmt.Errorf("GSTIN %s has the wrong check digit", gstin)
+	}
+	return nil
+}
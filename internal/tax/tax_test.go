@@ -0,0 +1,125 @@
+package tax
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLines(t *testing.T) {
+	maharashtra := Calculator{SellerState: "27", Rate: 1800}
+
+	tests := []struct {
+		name       string
+		calculator Calculator
+		taxable    int
+		buyer      string
+		want       []Line
+		wantErr    bool
+	}{
+		{"no seller state", Calculator{Rate: 1800}, 10000, "27", nil, false},
+		{"no rate", Calculator{SellerState: "27"}, 10000, "27", nil, false},
+		{"same state", maharashtra, 10000, "27", []Line{
+			{Name: "CGST", Rate: 900, Amount: 900},
+			{Name: "SGST", Rate: 900, Amount: 900},
+		}, false},
+		{"union territory", Calculator{SellerState: "04", Rate: 1800}, 10000, "04", []Line{
+			{Name: "CGST", Rate: 900, Amount: 900},
+			{Name: "UTGST", Rate: 900, Amount: 900},
+		}, false},
+		{"other state", maharashtra, 10000, "07", []Line{
+			{Name: "IGST", Rate: 1800, Amount: 1800},
+		}, false},
+		{"halves rounded alike", Calculator{SellerState: "27", Rate: 500}, 999, "27", []Line{
+			{Name: "CGST", Rate: 250, Amount: 25},
+			{Name: "SGST", Rate: 250, Amount: 25},
+		}, false},
+		{"unknown buyer state", maharashtra, 10000, "99", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.calculator.Lines(tt.taxable, tt.buyer)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Lines() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Lines() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int
+		wantErr bool
+	}{
+		{"18", 1800, false},
+		{" 5 ", 500, false},
+		{"0.5", 50, false},
+		{"0.1", 10, false},
+		{"0.25", 0, true},
+		{"0.01", 0, true},
+		{"0", 0, false},
+		{"100", 10000, false},
+		{"0.125", 0, true},
+		{"-1", 0, true},
+		{"101", 0, true},
+		{"eighteen", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseRate(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRate(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseRate(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCheckGSTIN(t *testing.T) {
+	tests := []struct {
+		gstin   string
+		wantErr bool
+	}{
+		{"27AAPFU0939F1ZV", false},
+		{"07AAACH7409R1Z3", false},
+		{"27AAPFU0939F1ZW", true},
+		{"99AAPFU0939F1ZV", true},
+		{"27aapfu0939f1zv", true},
+		{"27AAPFU0939F1Z", true},
+		{"", true},
+	}
+
+	for _, tt := range tests {
+		err := CheckGSTIN(tt.gstin)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("CheckGSTIN(%q) error = %v, wantErr %v", tt.gstin, err, tt.wantErr)
+		}
+	}
+}
+
+func TestEncodeParseLines(t *testing.T) {
+	lines := []Line{
+		{Name: "CGST", Rate: 900, Amount: 450},
+		{Name: "SGST", Rate: 900, Amount: 450},
+	}
+
+	got, err := ParseLines(EncodeLines(lines))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, lines) {
+		t.Errorf("ParseLines(EncodeLines()) = %v, want %v", got, lines)
+	}
+
+	for _, bad := range []string{"CGST:900", ":900:450", "CGST:x:450", "CGST:900:x"} {
+		if _, err := ParseLines(bad); err == nil {
+			t.Errorf("ParseLines(%q) did not fail", bad)
+		}
+	}
+}